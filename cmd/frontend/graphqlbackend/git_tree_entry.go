@@ -110,10 +110,41 @@ func (r *GitTreeEntryResolver) Highlight(ctx context.Context, args *HighlightArg
 	if err != nil {
 		return nil, err
 	}
+	var rowClasses map[int]string
+	if args.BaseRevision != nil {
+		rowClasses, err = r.addedSinceRowClasses(ctx, *args.BaseRevision, content)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return highlightContent(ctx, args, content, r.Path(), highlight.Metadata{
 		RepoName: string(r.commit.repoResolver.repo.Name),
 		Revision: string(r.commit.oid),
-	})
+	}, rowClasses)
+}
+
+// addedSinceRowClasses returns row classes marking the lines of content which
+// were added or changed compared to the file at the base revision. If the
+// file does not exist at base, all lines are marked.
+func (r *GitTreeEntryResolver) addedSinceRowClasses(ctx context.Context, base, content string) (map[int]string, error) {
+	cachedRepo, err := backend.CachedGitRepo(ctx, r.commit.repoResolver.repo)
+	if err != nil {
+		return nil, err
+	}
+	baseCommit, err := git.ResolveRevision(ctx, *cachedRepo, nil, base, git.ResolveRevisionOptions{})
+	if err != nil {
+		return nil, err
+	}
+	baseContent, err := git.ReadFile(ctx, *cachedRepo, baseCommit, r.Path(), 0)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	rowClasses := map[int]string{}
+	for _, line := range highlight.AddedLines(string(baseContent), content) {
+		rowClasses[line] = "diff-added"
+	}
+	return rowClasses, nil
 }
 
 func (r *GitTreeEntryResolver) Commit() *GitCommitResolver { return r.commit }
@@ -42,6 +42,15 @@ type HighlightArgs struct {
 	DisableTimeout     bool
 	IsLightTheme       bool
 	HighlightLongLines bool
+	RawHTML            bool
+	LineAnchors        bool
+	HighlightGenerated bool
+
+	// IgnoreWhitespace is only supported when highlighting diff hunks.
+	IgnoreWhitespace bool
+
+	// BaseRevision is only supported when highlighting blobs.
+	BaseRevision *string
 }
 
 type highlightedFileResolver struct {
@@ -52,7 +61,7 @@ type highlightedFileResolver struct {
 func (h *highlightedFileResolver) Aborted() bool { return h.aborted }
 func (h *highlightedFileResolver) HTML() string  { return h.html }
 
-func highlightContent(ctx context.Context, args *HighlightArgs, content, path string, metadata highlight.Metadata) (*highlightedFileResolver, error) {
+func highlightContent(ctx context.Context, args *HighlightArgs, content, path string, metadata highlight.Metadata, rowClasses map[int]string) (*highlightedFileResolver, error) {
 	var (
 		html            template.HTML
 		result          = &highlightedFileResolver{}
@@ -60,13 +69,20 @@ func highlightContent(ctx context.Context, args *HighlightArgs, content, path st
 		simulateTimeout = metadata.RepoName == "github.com/sourcegraph/AlwaysHighlightTimeoutTest"
 	)
 	html, result.aborted, err = highlight.Code(ctx, highlight.Params{
-		Content:            []byte(content),
-		Filepath:           path,
-		DisableTimeout:     args.DisableTimeout,
-		IsLightTheme:       args.IsLightTheme,
-		HighlightLongLines: args.HighlightLongLines,
-		SimulateTimeout:    simulateTimeout,
-		Metadata:           metadata,
+		Content:              []byte(content),
+		Filepath:             path,
+		DisableTimeout:       args.DisableTimeout,
+		IsLightTheme:         args.IsLightTheme,
+		HighlightLongLines:   args.HighlightLongLines,
+		HighlightGenerated:   args.HighlightGenerated,
+		Plaintext:            isPlaintextPath(metadata.RepoName, path),
+		RawHTML:              args.RawHTML,
+		LineAnchors:          args.LineAnchors,
+		RowClasses:           rowClasses,
+		ApplyHooks:           true,
+		FixedLineNumberWidth: true,
+		SimulateTimeout:      simulateTimeout,
+		Metadata:             metadata,
 	})
 	if err != nil {
 		return nil, err
@@ -0,0 +1,62 @@
+package graphqlbackend
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+
+	"github.com/inconshreveable/log15"
+	"github.com/sourcegraph/sourcegraph/internal/conf"
+	"github.com/sourcegraph/sourcegraph/internal/highlight"
+)
+
+func init() {
+	conf.ContributeValidator(func(c conf.Unified) (problems conf.Problems) {
+		for _, p := range c.HighlightPlaintextPaths {
+			if _, err := regexp.Compile(p.Repository); err != nil {
+				problems = append(problems, conf.NewSiteProblem(fmt.Sprintf("highlight.plaintextPaths: not a valid regexp: %s. See the valid syntax: https://golang.org/pkg/regexp/", p.Repository)))
+			}
+			for _, pattern := range p.Paths {
+				if _, err := path.Match(pattern, ""); err != nil {
+					problems = append(problems, conf.NewSiteProblem(fmt.Sprintf("highlight.plaintextPaths: not a valid glob pattern: %s. See the valid syntax: https://golang.org/pkg/path/#Match", pattern)))
+				}
+			}
+		}
+		return
+	})
+}
+
+type plaintextPathRule struct {
+	repository *regexp.Regexp
+	paths      []string
+}
+
+// plaintextPathRules is the list of paths which are never highlighted,
+// derived from the site config.
+var plaintextPathRules = conf.Cached(func() interface{} {
+	var rules []*plaintextPathRule
+	for _, p := range conf.Get().HighlightPlaintextPaths {
+		repository, err := regexp.Compile(p.Repository)
+		if err != nil {
+			// Skip if there's an error. A user-visible validation error will appear due to the ContributeValidator call above.
+			log15.Error("Site config: unable to compile highlight plaintext paths regexp", "regexp", p.Repository)
+			continue
+		}
+		rules = append(rules, &plaintextPathRule{
+			repository: repository,
+			paths:      p.Paths,
+		})
+	}
+	return rules
+})
+
+// isPlaintextPath reports whether the file at filepath in the given
+// repository is configured to always be rendered as plain text.
+func isPlaintextPath(repoName, filepath string) bool {
+	for _, r := range plaintextPathRules().([]*plaintextPathRule) {
+		if r.repository.MatchString(repoName) && highlight.MatchesPathPattern(r.paths, filepath) {
+			return true
+		}
+	}
+	return false
+}
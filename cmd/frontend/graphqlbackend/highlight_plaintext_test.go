@@ -0,0 +1,36 @@
+package graphqlbackend
+
+import (
+	"testing"
+
+	"github.com/sourcegraph/sourcegraph/internal/conf"
+	"github.com/sourcegraph/sourcegraph/schema"
+)
+
+func TestIsPlaintextPath(t *testing.T) {
+	conf.Mock(&conf.Unified{
+		SiteConfiguration: schema.SiteConfiguration{
+			HighlightPlaintextPaths: []*schema.HighlightPlaintextPaths{
+				{Repository: `^github\.com/acme/app$`, Paths: []string{"config/*.tmpl", "*.csv"}},
+				{Repository: `[`, Paths: []string{"*"}}, // invalid, ignored
+			},
+		},
+	})
+	defer conf.Mock(nil)
+
+	tests := []struct {
+		repo, path string
+		want       bool
+	}{
+		{repo: "github.com/acme/app", path: "config/prod.tmpl", want: true},
+		{repo: "github.com/acme/app", path: "data/x/users.csv", want: true},
+		{repo: "github.com/acme/app", path: "other/prod.tmpl", want: false},
+		{repo: "github.com/acme/app", path: "main.go", want: false},
+		{repo: "github.com/acme/app2", path: "users.csv", want: false},
+	}
+	for _, test := range tests {
+		if got := isPlaintextPath(test.repo, test.path); got != test.want {
+			t.Errorf("isPlaintextPath(%q, %q) = %v, want %v", test.repo, test.path, got, test.want)
+		}
+	}
+}
@@ -557,16 +557,16 @@ func (r *DiffHunk) Highlight(ctx context.Context, args *HighlightArgs) (*highlig
 		highlightedDiffHunkLineResolver := highlightedDiffHunkLineResolver{}
 		if hunkLine[0] == ' ' {
 			highlightedDiffHunkLineResolver.kind = "UNCHANGED"
-			highlightedDiffHunkLineResolver.html = string(highlightedBase[baseLine])
+			highlightedDiffHunkLineResolver.html = highlightedLine(highlightedBase, baseLine, hunkLine[1:])
 			baseLine++
 			headLine++
 		} else if hunkLine[0] == '+' {
 			highlightedDiffHunkLineResolver.kind = "ADDED"
-			highlightedDiffHunkLineResolver.html = string(highlightedHead[headLine])
+			highlightedDiffHunkLineResolver.html = highlightedLine(highlightedHead, headLine, hunkLine[1:])
 			headLine++
 		} else if hunkLine[0] == '-' {
 			highlightedDiffHunkLineResolver.kind = "DELETED"
-			highlightedDiffHunkLineResolver.html = string(highlightedBase[baseLine])
+			highlightedDiffHunkLineResolver.html = highlightedLine(highlightedBase, baseLine, hunkLine[1:])
 			baseLine++
 		} else {
 			return nil, fmt.Errorf("expected patch lines to start with ' ', '-', '+', but found %q", hunkLine[0])
@@ -574,12 +574,89 @@ func (r *DiffHunk) Highlight(ctx context.Context, args *HighlightArgs) (*highlig
 
 		highlightedDiffHunkLineResolvers[i] = &highlightedDiffHunkLineResolver
 	}
+	if args.IgnoreWhitespace {
+		highlightedDiffHunkLineResolvers = ignoreWhitespaceChanges(highlightedDiffHunkLineResolvers, hunkLines)
+	}
 	return &highlightedDiffHunkBodyResolver{
 		highlightedDiffHunkLineResolvers: highlightedDiffHunkLineResolvers,
 		aborted:                          aborted,
 	}, nil
 }
 
+// highlightedLine returns the highlighted HTML of the 0-based line of a file,
+// or text as plain HTML if the file's highlighted lines do not include it
+// (e.g. because the file does not match the hunk).
+func highlightedLine(lines []template.HTML, line int32, text string) string {
+	if line < 0 || int(line) >= len(lines) {
+		// The hunk line of a CRLF file keeps its CR, which the highlighted
+		// rows drop with the rest of the line ending.
+		text = strings.TrimSuffix(text, "\r")
+		if text == "" {
+			text = "\n" // match the plain text rows of highlighted files
+		}
+		return "<span>" + template.HTMLEscapeString(text) + "</span>"
+	}
+	return string(lines[line])
+}
+
+// ignoreWhitespaceChanges rewrites the highlighted lines of a hunk so that a
+// deleted line and the added line replacing it, which differ only in
+// whitespace, are shown as a single unchanged (head) line. hunkLines are the
+// raw hunk lines corresponding to lines.
+//
+// Within each run of deleted lines followed by added lines, the i-th deleted
+// line is compared with the i-th added line. The relative order of the
+// remaining base and head lines is preserved, so line numbers derived from
+// the line kinds stay correct.
+func ignoreWhitespaceChanges(lines []*highlightedDiffHunkLineResolver, hunkLines []string) []*highlightedDiffHunkLineResolver {
+	result := make([]*highlightedDiffHunkLineResolver, 0, len(lines))
+	for i := 0; i < len(lines); {
+		if lines[i].kind != "DELETED" {
+			result = append(result, lines[i])
+			i++
+			continue
+		}
+
+		// Find the run of deleted lines and the run of added lines after it.
+		delStart := i
+		for i < len(lines) && lines[i].kind == "DELETED" {
+			i++
+		}
+		addStart := i
+		for i < len(lines) && lines[i].kind == "ADDED" {
+			i++
+		}
+		deleted, added := lines[delStart:addStart], lines[addStart:i]
+		deletedText, addedText := hunkLines[delStart:addStart], hunkLines[addStart:i]
+
+		var pendingDeleted, pendingAdded []*highlightedDiffHunkLineResolver
+		for j := 0; j < len(deleted) || j < len(added); j++ {
+			if j < len(deleted) && j < len(added) && equalIgnoringWhitespace(deletedText[j][1:], addedText[j][1:]) {
+				result = append(result, pendingDeleted...)
+				result = append(result, pendingAdded...)
+				pendingDeleted, pendingAdded = nil, nil
+				result = append(result, &highlightedDiffHunkLineResolver{kind: "UNCHANGED", html: added[j].html})
+				continue
+			}
+			if j < len(deleted) {
+				pendingDeleted = append(pendingDeleted, deleted[j])
+			}
+			if j < len(added) {
+				pendingAdded = append(pendingAdded, added[j])
+			}
+		}
+		result = append(result, pendingDeleted...)
+		result = append(result, pendingAdded...)
+	}
+	return result
+}
+
+// equalIgnoringWhitespace reports whether a and b are equal after removing
+// all whitespace.
+func equalIgnoringWhitespace(a, b string) bool {
+	return strings.Join(strings.Fields(a), "") == strings.Join(strings.Fields(b), "")
+}
+
 type highlightedDiffHunkBodyResolver struct {
 	highlightedDiffHunkLineResolvers []*highlightedDiffHunkLineResolver
 	aborted                          bool
@@ -522,6 +522,155 @@ const testDiffFirstHunk = ` Line 1
  Line 10
 `
 
+func TestDiffHunk_IgnoreWhitespace(t *testing.T) {
+	hunk := &DiffHunk{
+		hunk: &diff.Hunk{
+			OrigStartLine: 1,
+			OrigLines:     5,
+			NewStartLine:  1,
+			NewLines:      5,
+			Body: []byte(` a
+-if x {
+-  b()
+-c()
++if x  {
++    b()
++d()
+ e
+-f
++ f
+`),
+		},
+		highlighter: &dummyFileHighlighter{
+			highlightedBase: []template.HTML{"B1", "B2", "B3", "B4", "B5", "B6"},
+			highlightedHead: []template.HTML{"H1", "H2", "H3", "H4", "H5", "H6"},
+		},
+	}
+
+	for _, tc := range []struct {
+		ignoreWhitespace bool
+		want             []string
+	}{
+		{
+			ignoreWhitespace: false,
+			want: []string{
+				"UNCHANGED B1",
+				"DELETED B2", "DELETED B3", "DELETED B4",
+				"ADDED H2", "ADDED H3", "ADDED H4",
+				"UNCHANGED B5",
+				"DELETED B6", "ADDED H6",
+			},
+		},
+		{
+			ignoreWhitespace: true,
+			want: []string{
+				"UNCHANGED B1",
+				"UNCHANGED H2", "UNCHANGED H3",
+				"DELETED B4", "ADDED H4",
+				"UNCHANGED B5",
+				"UNCHANGED H6",
+			},
+		},
+	} {
+		body, err := hunk.Highlight(context.Background(), &HighlightArgs{IgnoreWhitespace: tc.ignoreWhitespace})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var have []string
+		for _, line := range body.Lines() {
+			have = append(have, line.Kind()+" "+line.HTML())
+		}
+		if diff := cmp.Diff(tc.want, have); diff != "" {
+			t.Fatalf("ignoreWhitespace=%t: wrong lines (-want +have):\n%s", tc.ignoreWhitespace, diff)
+		}
+	}
+}
+
+func TestDiffHunk_BeyondHighlightedLines(t *testing.T) {
+	// The highlighted lines do not reach the hunk (e.g. the highlighted file
+	// was shorter than the diffed one), so its lines are rendered as plain
+	// text instead of panicking. The CR of a CRLF line is not shown.
+	hunk := &DiffHunk{
+		hunk: &diff.Hunk{
+			OrigStartLine: 2,
+			OrigLines:     2,
+			NewStartLine:  2,
+			NewLines:      2,
+			Body:          []byte(" a\n-<b>\n+c\r\n"),
+		},
+		highlighter: &dummyFileHighlighter{
+			highlightedBase: []template.HTML{"B1", "B2"},
+			highlightedHead: []template.HTML{"H1"},
+		},
+	}
+	body, err := hunk.Highlight(context.Background(), &HighlightArgs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have []string
+	for _, line := range body.Lines() {
+		have = append(have, line.Kind()+" "+line.HTML())
+	}
+	want := []string{"UNCHANGED B2", "DELETED <span>&lt;b&gt;</span>", "ADDED <span>c</span>"}
+	if diff := cmp.Diff(want, have); diff != "" {
+		t.Fatalf("wrong lines (-want +have):\n%s", diff)
+	}
+}
+
+func TestDiffHunk_LineEndings(t *testing.T) {
+	// Render files as plain text with the real highlighter, so that its rows
+	// are numbered as in production.
+	var plaintext func(p highlight.Params) (template.HTML, bool, error)
+	plaintext = func(p highlight.Params) (template.HTML, bool, error) {
+		highlight.ResetMocks()
+		defer func() { highlight.Mocks.Code = plaintext }()
+		p.Plaintext = true
+		return highlight.Code(context.Background(), p)
+	}
+	highlight.Mocks.Code = plaintext
+	t.Cleanup(highlight.ResetMocks)
+
+	// A CRLF file in which git does not end a line at the lone CR.
+	file := func(content string) *dummyFileResolver {
+		return &dummyFileResolver{
+			path:    "a.txt",
+			content: func(context.Context) (string, error) { return content, nil },
+		}
+	}
+	hunk := &DiffHunk{
+		hunk: &diff.Hunk{
+			OrigStartLine: 1,
+			OrigLines:     4,
+			NewStartLine:  1,
+			NewLines:      5,
+			Body:          []byte(" a\r\n-b\rc\r\n+B\rc\r\n d\r\n e\r\n+f\r\n"),
+		},
+		highlighter: &fileDiffHighlighter{
+			oldFile: file("a\r\nb\rc\r\nd\r\ne\r\n"),
+			newFile: file("a\r\nB\rc\r\nd\r\ne\r\nf\r\n"),
+		},
+	}
+	body, err := hunk.Highlight(context.Background(), &HighlightArgs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have []string
+	for _, line := range body.Lines() {
+		have = append(have, line.Kind()+" "+line.HTML())
+	}
+	want := []string{
+		"UNCHANGED <span>a</span>",
+		"DELETED <span>b&#13;c</span>",
+		"ADDED <span>B&#13;c</span>",
+		"UNCHANGED <span>d</span>",
+		"UNCHANGED <span>e</span>",
+		"ADDED <span>f</span>",
+	}
+	if diff := cmp.Diff(want, have); diff != "" {
+		t.Fatalf("wrong lines (-want +have):\n%s", diff)
+	}
+}
+
 func TestFileDiffHighlighter(t *testing.T) {
 	ctx := context.Background()
 
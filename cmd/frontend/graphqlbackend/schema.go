@@ -3835,6 +3835,11 @@ type FileDiffHunk {
         rendering efficiently.
         """
         highlightLongLines: Boolean = false
+        """
+        If ignoreWhitespace is true, a deleted line and the added line replacing it
+        which differ only in whitespace are returned as a single UNCHANGED line.
+        """
+        ignoreWhitespace: Boolean = false
     ): HighlightedDiffHunkBody!
 }
 
@@ -4856,6 +4861,21 @@ interface File2 {
         rendering efficiently.
         """
         highlightLongLines: Boolean = false
+        """
+        If rawHTML is true, the HTML is syntect_server's highlighted <pre> element instead
+        of a table with one row per line.
+        """
+        rawHTML: Boolean = false
+        """
+        If lineAnchors is true, the line number cell of each line has an id of the form
+        L{n} (e.g. L42), so that browsers can navigate directly to a line.
+        """
+        lineAnchors: Boolean = false
+        """
+        If highlightGenerated is true, vendored and generated files are highlighted even if the
+        site is configured to render them as plain text.
+        """
+        highlightGenerated: Boolean = false
     ): HighlightedFile!
 }
 
@@ -4918,6 +4938,21 @@ type VirtualFile implements File2 {
         rendering efficiently.
         """
         highlightLongLines: Boolean = false
+        """
+        If rawHTML is true, the HTML is syntect_server's highlighted <pre> element instead
+        of a table with one row per line.
+        """
+        rawHTML: Boolean = false
+        """
+        If lineAnchors is true, the line number cell of each line has an id of the form
+        L{n} (e.g. L42), so that browsers can navigate directly to a line.
+        """
+        lineAnchors: Boolean = false
+        """
+        If highlightGenerated is true, vendored and generated files are highlighted even if the
+        site is configured to render them as plain text.
+        """
+        highlightGenerated: Boolean = false
     ): HighlightedFile!
 }
 
@@ -5008,7 +5043,38 @@ type GitBlob implements TreeEntry & File2 {
     """
     Highlight the blob contents.
     """
-    highlight(disableTimeout: Boolean!, isLightTheme: Boolean!, highlightLongLines: Boolean = false): HighlightedFile!
+    highlight(
+        disableTimeout: Boolean!
+        isLightTheme: Boolean!
+        """
+        If highlightLongLines is true, lines which are longer than 2000 bytes are highlighted.
+        2000 bytes is enabled. This may produce a significant amount of HTML
+        which some browsers (such as Chrome, but not Firefox) may have trouble
+        rendering efficiently.
+        """
+        highlightLongLines: Boolean = false
+        """
+        If rawHTML is true, the HTML is syntect_server's highlighted <pre> element instead
+        of a table with one row per line.
+        """
+        rawHTML: Boolean = false
+        """
+        If lineAnchors is true, the line number cell of each line has an id of the form
+        L{n} (e.g. L42), so that browsers can navigate directly to a line.
+        """
+        lineAnchors: Boolean = false
+        """
+        If highlightGenerated is true, vendored and generated files are highlighted even if the
+        site is configured to render them as plain text.
+        """
+        highlightGenerated: Boolean = false
+        """
+        If baseRevision is set, the rows of lines which were added or changed compared to the
+        file at that revision have the class "diff-added". If the file does not exist at the
+        base revision, all lines are marked.
+        """
+        baseRevision: String
+    ): HighlightedFile!
     """
     Submodule metadata if this tree points to a submodule
     """
@@ -98,5 +98,5 @@ func (r *virtualFileResolver) Highlight(ctx context.Context, args *HighlightArgs
 	return highlightContent(ctx, args, content, r.Path(), highlight.Metadata{
 		// TODO: Use `CanonicalURL` here for where to retrieve the file content, once we have a backend to retrieve such files.
 		Revision: fmt.Sprintf("Preview file diff %s", r.stat.Name()),
-	})
+	}, nil)
 }
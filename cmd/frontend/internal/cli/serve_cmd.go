@@ -9,10 +9,12 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/inconshreveable/log15"
@@ -33,6 +35,7 @@ import (
 	"github.com/sourcegraph/sourcegraph/internal/debugserver"
 	"github.com/sourcegraph/sourcegraph/internal/env"
 	"github.com/sourcegraph/sourcegraph/internal/goroutine"
+	"github.com/sourcegraph/sourcegraph/internal/highlight"
 	"github.com/sourcegraph/sourcegraph/internal/logging"
 	"github.com/sourcegraph/sourcegraph/internal/processrestart"
 	"github.com/sourcegraph/sourcegraph/internal/secrets"
@@ -259,15 +262,11 @@ func Main(enterpriseSetupHook func() enterprise.Services) error {
 		})
 	}
 
-	go func() {
-		<-processrestart.WillRestart
-		// Block forever so we don't return from main func and exit this process. Package processrestart takes care
-		// of killing and restarting this process externally.
-		srv.wg.Add(1)
-
-		log15.Debug("Stopping HTTP server due to imminent restart")
-		srv.Close()
-	}()
+	// Close the servers gracefully when the process is about to restart, or
+	// is asked to stop (e.g. by a rolling deploy).
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go srv.closeOnShutdown(processrestart.WillRestart, signals)
 
 	if printLogo {
 		fmt.Println(" ")
@@ -328,6 +327,42 @@ func (s *httpServers) Close() {
 	s.servers = nil
 }
 
+// highlightDrainTimeout is how long in-flight syntax highlighting requests
+// may take to finish before the servers are closed.
+const highlightDrainTimeout = 10 * time.Second
+
+// drainHighlights is highlight.Drain. It is a variable so that tests can
+// observe it.
+var drainHighlights = highlight.Drain
+
+// closeOnShutdown closes all servers once willRestart is closed or a signal
+// is received. It first lets in-flight syntax highlighting requests finish,
+// so that users don't see errors during restarts and deploys.
+//
+// After a signal, Wait returns once the servers are closed and the process
+// exits; a second signal terminates it immediately. Before a restart, Wait
+// blocks forever, since package processrestart takes care of killing and
+// restarting this process externally.
+func (s *httpServers) closeOnShutdown(willRestart <-chan struct{}, signals chan os.Signal) {
+	select {
+	case <-willRestart:
+		// Block forever so we don't return from main func and exit this process.
+		s.wg.Add(1)
+		log15.Debug("Stopping HTTP server due to imminent restart")
+	case sig := <-signals:
+		signal.Stop(signals)
+		log15.Info("Stopping HTTP server", "signal", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), highlightDrainTimeout)
+	if err := drainHighlights(ctx); err != nil {
+		log15.Warn("Timed out waiting for syntax highlighting requests to finish", "error", err)
+	}
+	cancel()
+
+	s.Close()
+}
+
 // Wait waits until all servers are closed.
 func (s *httpServers) Wait() {
 	s.wg.Wait()
@@ -0,0 +1,56 @@
+package cli
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHTTPServers_CloseOnShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &httpServers{}
+	srv.GoServe(l, &http.Server{Handler: http.NotFoundHandler()})
+
+	// The servers must still be open while highlighting requests drain.
+	var drained bool
+	orig := drainHighlights
+	drainHighlights = func(ctx context.Context) error {
+		drained = true
+		if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > highlightDrainTimeout {
+			t.Errorf("got deadline %v, want one within %v", deadline, highlightDrainTimeout)
+		}
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err != nil {
+			t.Errorf("expected server to be open while draining: %v", err)
+		} else {
+			resp.Body.Close()
+		}
+		return nil
+	}
+	t.Cleanup(func() { drainHighlights = orig })
+
+	signals := make(chan os.Signal, 1)
+	signals <- syscall.SIGTERM
+	go srv.closeOnShutdown(make(chan struct{}), signals)
+
+	done := make(chan struct{})
+	go func() {
+		srv.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected servers to close after SIGTERM")
+	}
+	if !drained {
+		t.Fatal("expected highlighting requests to be drained before closing")
+	}
+}
@@ -0,0 +1,208 @@
+package highlight
+
+import (
+	"html/template"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// ANSI converts a table produced by Code into text with ANSI escape sequences,
+// suitable for displaying highlighted code in a terminal. Span colors are
+// mapped to the nearest color of the xterm 256-color palette, and bold spans
+// are rendered bold.
+//
+// Control characters in the code other than tab are shown in caret notation.
+// If tty is false, the plain text is returned instead (see Plaintext).
+func ANSI(table template.HTML, tty bool) (string, error) {
+	if !tty {
+		return Plaintext(table)
+	}
+
+	_, firstRow, err := parseTable(string(table))
+	if err != nil {
+		return "", err
+	}
+
+	var buf strings.Builder
+	for tr := firstRow; tr != nil && !isTruncationRow(tr); tr = tr.NextSibling {
+		if tr != firstRow {
+			buf.WriteByte('\n')
+		}
+		var runs []ansiRun
+		collectRuns(&runs, tr.LastChild, ansiStyle{}) // tr > td.code
+		if len(runs) > 0 {
+			last := &runs[len(runs)-1]
+			last.text = lineText(last.text)
+		}
+		for _, run := range runs {
+			if run.text == "" {
+				continue
+			}
+			if sgr := run.style.sgr(); sgr != "" {
+				buf.WriteString("\x1b[" + sgr + "m")
+				writeTerminalText(&buf, run.text)
+				buf.WriteString("\x1b[0m")
+			} else {
+				writeTerminalText(&buf, run.text)
+			}
+		}
+	}
+	return buf.String(), nil
+}
+
+// writeTerminalText writes text to buf, replacing control characters other
+// than tab with their caret notation (e.g. ESC becomes "^["). The text comes
+// from repository contents, which must not be able to send escape sequences
+// to the terminal.
+func writeTerminalText(buf *strings.Builder, text string) {
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c == '\t' || (c >= 0x20 && c != 0x7f):
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte('^')
+			buf.WriteByte(c ^ 0x40)
+		}
+	}
+}
+
+// ansiStyle is the text style of a span, as far as it can be rendered in a
+// terminal.
+type ansiStyle struct {
+	bold, italic, underline bool
+	color                   string // SGR parameters of the foreground color
+}
+
+// ansiRun is a piece of text within a line and the style it is rendered in.
+type ansiRun struct {
+	text  string
+	style ansiStyle
+}
+
+// collectRuns appends the text below n to runs. Spans may be nested; the
+// declarations of an inner span override those of the spans around it.
+func collectRuns(runs *[]ansiRun, n *html.Node, style ansiStyle) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		switch {
+		case c.Type == html.TextNode:
+			*runs = append(*runs, ansiRun{text: c.Data, style: style})
+		case c.Type == html.ElementNode && c.DataAtom == atom.Span:
+			collectRuns(runs, c, spanStyle(c, style))
+		default:
+			collectRuns(runs, c, style)
+		}
+	}
+}
+
+// spanStyle returns the style of a span produced by syntect_server, given the
+// style of its parent. The span's inline style looks like e.g.
+// "font-weight:bold;color:#a71d5d;".
+func spanStyle(span *html.Node, parent ansiStyle) ansiStyle {
+	var styleAttr string
+	for _, a := range span.Attr {
+		if a.Key == "style" {
+			styleAttr = a.Val
+		}
+	}
+
+	style := parent
+	for _, decl := range strings.Split(styleAttr, ";") {
+		kv := strings.SplitN(decl, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "font-weight":
+			style.bold = value == "bold"
+		case "font-style":
+			style.italic = value == "italic"
+		case "text-decoration":
+			style.underline = value == "underline"
+		case "color":
+			if r, g, b, ok := parseHexColor(value); ok {
+				style.color = "38;5;" + strconv.Itoa(nearestXterm256(r, g, b))
+			}
+		}
+	}
+	return style
+}
+
+// sgr returns the ANSI SGR parameters which select the style.
+func (s ansiStyle) sgr() string {
+	var params []string
+	if s.bold {
+		params = append(params, "1")
+	}
+	if s.italic {
+		params = append(params, "3")
+	}
+	if s.underline {
+		params = append(params, "4")
+	}
+	if s.color != "" {
+		params = append(params, s.color)
+	}
+	return strings.Join(params, ";")
+}
+
+// parseHexColor parses a CSS color of the form #rrggbb.
+func parseHexColor(s string) (r, g, b int, ok bool) {
+	if len(s) != 7 || s[0] != '#' {
+		return 0, 0, 0, false
+	}
+	v, err := strconv.ParseUint(s[1:], 16, 32)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	return int(v >> 16 & 0xff), int(v >> 8 & 0xff), int(v & 0xff), true
+}
+
+// xtermCubeLevels are the intensities used by the 6x6x6 color cube of the
+// xterm 256-color palette (colors 16-231).
+var xtermCubeLevels = [6]int{0, 95, 135, 175, 215, 255}
+
+// nearestXterm256 returns the xterm 256-color palette index closest to the
+// given RGB color, considering the color cube and the grayscale ramp.
+func nearestXterm256(r, g, b int) int {
+	nearestLevel := func(v int) int {
+		best := 0
+		for i, level := range xtermCubeLevels {
+			if abs(v-level) < abs(v-xtermCubeLevels[best]) {
+				best = i
+			}
+		}
+		return best
+	}
+	ri, gi, bi := nearestLevel(r), nearestLevel(g), nearestLevel(b)
+	cube := 16 + 36*ri + 6*gi + bi
+	cubeDist := colorDist(r, g, b, xtermCubeLevels[ri], xtermCubeLevels[gi], xtermCubeLevels[bi])
+
+	// The grayscale ramp (colors 232-255) has intensities 8, 18, ..., 238.
+	avg := (r + g + b) / 3
+	grayIndex := (avg - 8 + 5) / 10
+	if grayIndex < 0 {
+		grayIndex = 0
+	} else if grayIndex > 23 {
+		grayIndex = 23
+	}
+	gray := 8 + 10*grayIndex
+	if colorDist(r, g, b, gray, gray, gray) < cubeDist {
+		return 232 + grayIndex
+	}
+	return cube
+}
+
+func colorDist(r1, g1, b1, r2, g2, b2 int) int {
+	return (r1-r2)*(r1-r2) + (g1-g2)*(g1-g2) + (b1-b2)*(b1-b2)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
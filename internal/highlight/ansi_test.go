@@ -0,0 +1,93 @@
+package highlight
+
+import (
+	"html/template"
+	"testing"
+)
+
+func TestANSI(t *testing.T) {
+	table := template.HTML(`<table><tr><td class="line" data-line="1"></td><td class="code"><div><span style="font-weight:bold;color:#a71d5d;">package</span><span style="color:#323232;"> main
+</span></div></td></tr><tr><td class="line" data-line="2"></td><td class="code"><div><span>
+</span></div></td></tr><tr><td class="line" data-line="3"></td><td class="code"><div><span style="color:#ffffff;">&lt;x&gt;</span></div></td></tr></table>`)
+
+	got, err := ANSI(table, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "\x1b[1;38;5;125mpackage\x1b[0m\x1b[38;5;236m main\x1b[0m\n\n\x1b[38;5;231m<x>\x1b[0m"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	got, err = ANSI(table, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "package main\n\n<x>"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestANSI_NestedSpansAndTruncation(t *testing.T) {
+	table := template.HTML(`<table><tr><td class="line" data-line="1"></td><td class="code"><div><span style="color:#323232;">a <span style="font-weight:bold;color:#ff0000;">b</span> c
+</span></div></td></tr><tr class="truncated" data-truncated-lines="42"><td class="line"></td><td class="code"><div><span>… 42 more lines not shown</span></div></td></tr></table>`)
+
+	got, err := ANSI(table, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "\x1b[38;5;236ma \x1b[0m\x1b[1;38;5;196mb\x1b[0m\x1b[38;5;236m c\x1b[0m"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestANSI_ControlCharacters(t *testing.T) {
+	table := template.HTML("<table><tr><td class=\"line\" data-line=\"1\"></td><td class=\"code\"><div><span style=\"color:#ff0000;\">a\x1b]0;pwned\a\tb\x7f</span><span>\x1b[2J\n</span></div></td></tr></table>")
+
+	got, err := ANSI(table, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "\x1b[38;5;196ma^[]0;pwned^G\tb^?\x1b[0m^[[2J"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestNearestXterm256(t *testing.T) {
+	tests := []struct {
+		r, g, b int
+		want    int
+	}{
+		{0, 0, 0, 16},
+		{255, 255, 255, 231},
+		{255, 0, 0, 196},
+		{0, 0, 255, 21},
+		{128, 128, 128, 244},
+		{95, 135, 175, 67},
+	}
+	for _, test := range tests {
+		if got := nearestXterm256(test.r, test.g, test.b); got != test.want {
+			t.Errorf("nearestXterm256(%d, %d, %d) = %d, want %d", test.r, test.g, test.b, got, test.want)
+		}
+	}
+}
+
+func TestANSI_Grid(t *testing.T) {
+	opt := Params{Grid: true}.tableOptions("a\nb")
+	table, _, err := preSpansToTable(`<pre>
+<span style="color:#ff0000;">a
+</span><span>b</span></pre>`, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ANSI(template.HTML(table), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "\x1b[38;5;196ma\x1b[0m\nb"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,50 @@
+package highlight
+
+import (
+	"context"
+	"html/template"
+	"sync"
+)
+
+// batchConcurrency is the maximum number of files CodeBatch highlights
+// concurrently.
+var batchConcurrency = envInt("SRC_HIGHLIGHT_BATCH_CONCURRENCY", 4, "maximum number of files highlighted concurrently for a single batch highlighting request")
+
+// BatchResult is the result of highlighting a single file with CodeBatch.
+// The fields correspond to the return values of Code.
+type BatchResult struct {
+	HTML    template.HTML
+	Aborted bool
+	Err     error
+}
+
+// CodeBatch highlights multiple files, such as the files of a search results
+// page, with bounded concurrency. Each file is highlighted as by Code
+// (including its size, timeout and binary handling), and the results are
+// returned in the same order as params. An error highlighting one file does
+// not affect the others.
+func CodeBatch(ctx context.Context, params []Params) []BatchResult {
+	concurrency := batchConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		results = make([]BatchResult, len(params))
+		sem     = make(chan struct{}, concurrency)
+		wg      sync.WaitGroup
+	)
+	for i, p := range params {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(r *BatchResult, p Params) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			r.HTML, r.Aborted, r.Err = Code(ctx, p)
+		}(&results[i], p)
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,66 @@
+package highlight
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestCodeBatch(t *testing.T) {
+	orig := batchConcurrency
+	batchConcurrency = 2
+	t.Cleanup(func() { batchConcurrency = orig })
+
+	var (
+		mu                  sync.Mutex
+		running, maxRunning int
+	)
+	Mocks.Code = func(p Params) (template.HTML, bool, error) {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+
+		switch p.Filepath {
+		case "a.go", "b.go":
+			return template.HTML(p.Filepath), false, nil
+		case "slow.go":
+			return "slow", true, nil
+		case "binary":
+			return "", false, ErrBinary
+		}
+		return "", false, errors.New("unexpected filepath")
+	}
+	t.Cleanup(ResetMocks)
+
+	results := CodeBatch(context.Background(), []Params{
+		{Filepath: "a.go"},
+		{Filepath: "binary"},
+		{Filepath: "slow.go"},
+		{Filepath: "b.go"},
+	})
+	want := []BatchResult{
+		{HTML: "a.go"},
+		{Err: ErrBinary},
+		{HTML: "slow", Aborted: true},
+		{HTML: "b.go"},
+	}
+	if diff := cmp.Diff(want, results, cmpopts.EquateErrors()); diff != "" {
+		t.Fatalf("unexpected results (-want +got):\n%s", diff)
+	}
+	if maxRunning > 2 {
+		t.Fatalf("expected at most 2 concurrent highlights, got %d", maxRunning)
+	}
+}
@@ -0,0 +1,46 @@
+package highlight
+
+import (
+	"strings"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// AddedLines returns the 1-based line numbers of the lines of head which were
+// added or changed compared to base, e.g. to mark what changed in a file
+// since an earlier revision. Line numbers match the rows produced by Code for
+// head. If base is empty (e.g. the file did not exist), all lines are
+// returned. Changes from LF to CRLF line endings (or back) alone are ignored.
+func AddedLines(base, head string) []int {
+	dmp := diffmatchpatch.New()
+	baseChars, headChars, lines := dmp.DiffLinesToChars(diffLines(base), diffLines(head))
+	diffs := dmp.DiffCharsToLines(dmp.DiffMain(baseChars, headChars, false), lines)
+
+	var (
+		added []int
+		line  = 1
+	)
+	for _, d := range diffs {
+		n := strings.Count(d.Text, "\n")
+		switch d.Type {
+		case diffmatchpatch.DiffEqual:
+			line += n
+		case diffmatchpatch.DiffInsert:
+			for i := 0; i < n; i++ {
+				added = append(added, line)
+				line++
+			}
+		}
+	}
+	return added
+}
+
+// diffLines normalizes code the same way Code does, so that every line
+// (including the last) ends with a newline.
+func diffLines(code string) string {
+	code = strings.TrimSuffix(normalizeNewlines(code), "\n")
+	if code == "" {
+		return ""
+	}
+	return code + "\n"
+}
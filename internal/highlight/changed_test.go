@@ -0,0 +1,31 @@
+package highlight
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAddedLines(t *testing.T) {
+	tests := []struct {
+		name       string
+		base, head string
+		want       []int
+	}{
+		{name: "unchanged", base: "a\nb\n", head: "a\r\nb", want: nil},
+		{name: "no base", base: "", head: "a\nb\n", want: []int{1, 2}},
+		{name: "added and changed", base: "a\nb\nc\n", head: "a\nx\nb\nC\n", want: []int{2, 4}},
+		{name: "removed", base: "a\nb\nc", head: "a\nc", want: nil},
+		{name: "changed last line", base: "a\nb", head: "a\nb2", want: []int{2}},
+		// A stray CR does not end a line, as in git.
+		{name: "CR", base: "a\r\nb\r\nc\r\n", head: "a\r\nb\rB\r\nc\r\n", want: []int{2}},
+		{name: "CR only", base: "a\rb\rc", head: "a\rB\rc", want: []int{1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if diff := cmp.Diff(test.want, AddedLines(test.base, test.head)); diff != "" {
+				t.Fatalf("unexpected added lines (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
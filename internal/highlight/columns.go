@@ -0,0 +1,112 @@
+package highlight
+
+import (
+	"context"
+	"html/template"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A ColumnMap translates between byte offsets, rune columns and grapheme
+// columns in the text of a highlighted line, for clients which need to
+// address multi-byte or combining characters by column (e.g. to place a
+// cursor or select a range). All offsets and columns are 0-based.
+type ColumnMap struct {
+	// Runes holds the byte offset at which each rune starts, followed by
+	// the length of the text in bytes.
+	Runes []int
+
+	// Graphemes holds the rune column at which each grapheme starts,
+	// followed by the number of runes. A grapheme is approximated as a rune
+	// followed by any combining marks and zero width joiner sequences.
+	Graphemes []int
+}
+
+// ByteOffset returns the byte offset of the given rune column.
+func (m ColumnMap) ByteOffset(runeCol int) int {
+	return m.Runes[clamp(runeCol, len(m.Runes)-1)]
+}
+
+// RuneColumn returns the column of the rune containing the given byte offset.
+func (m ColumnMap) RuneColumn(offset int) int {
+	return containing(m.Runes, offset)
+}
+
+// GraphemeColumn returns the column of the grapheme containing the given rune
+// column.
+func (m ColumnMap) GraphemeColumn(runeCol int) int {
+	return containing(m.Graphemes, runeCol)
+}
+
+// RuneColumnOfGrapheme returns the rune column at which the given grapheme
+// column starts.
+func (m ColumnMap) RuneColumnOfGrapheme(graphemeCol int) int {
+	return m.Graphemes[clamp(graphemeCol, len(m.Graphemes)-1)]
+}
+
+// containing returns the index i of the interval [starts[i], starts[i+1])
+// containing x, clamped to the valid indexes.
+func containing(starts []int, x int) int {
+	i := sort.SearchInts(starts, x+1) - 1
+	return clamp(i, len(starts)-1)
+}
+
+func clamp(i, last int) int {
+	if i < 0 {
+		return 0
+	}
+	if i > last {
+		return last
+	}
+	return i
+}
+
+// newColumnMap returns the column map of text.
+func newColumnMap(text string) ColumnMap {
+	m := ColumnMap{
+		Runes:     make([]int, 0, len(text)+1),
+		Graphemes: make([]int, 0, len(text)+1),
+	}
+	const zwj = '\u200d' // zero width joiner
+	join := false
+	for offset, r := range text {
+		col := len(m.Runes)
+		m.Runes = append(m.Runes, offset)
+		if col == 0 || !(join || r == zwj || unicode.Is(unicode.M, r)) {
+			m.Graphemes = append(m.Graphemes, col)
+		}
+		join = r == zwj
+	}
+	m.Runes = append(m.Runes, len(text))
+	m.Graphemes = append(m.Graphemes, utf8.RuneCountInString(text))
+	return m
+}
+
+// columnMaps returns the column map of each line of text.
+func columnMaps(text string) []ColumnMap {
+	lines := strings.Split(text, "\n")
+	maps := make([]ColumnMap, 0, len(lines))
+	for _, line := range lines {
+		maps = append(maps, newColumnMap(line))
+	}
+	return maps
+}
+
+// CodeAsLinesWithColumns is like CodeAsLines, but also returns the column map
+// of each line. Computing the column maps has a cost, so callers which do not
+// need them should use CodeAsLines.
+func CodeAsLinesWithColumns(ctx context.Context, p Params) ([]template.HTML, []ColumnMap, bool, error) {
+	lines, aborted, err := CodeAsLines(ctx, p)
+	if err != nil {
+		return nil, nil, aborted, err
+	}
+	// The text of the highlighted lines is the text Code sent to be
+	// highlighted, so there is no need to extract it from the HTML again.
+	maps := columnMaps(codeText(p.Content))
+	if len(maps) > len(lines) {
+		maps = maps[:len(lines)]
+	}
+	return lines, maps, aborted, nil
+}
@@ -0,0 +1,61 @@
+package highlight
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestColumnMaps(t *testing.T) {
+	// "e" followed by a combining acute accent, and a family emoji made of
+	// three code points joined by zero width joiners.
+	maps := columnMaps("aé\ne\u0301x\U0001F468\u200d\U0001F469\n")
+	want := []ColumnMap{
+		{Runes: []int{0, 1, 3}, Graphemes: []int{0, 1, 2}},
+		{Runes: []int{0, 1, 3, 4, 8, 11, 15}, Graphemes: []int{0, 2, 3, 6}},
+		{Runes: []int{0}, Graphemes: []int{0}},
+	}
+	if diff := cmp.Diff(want, maps); diff != "" {
+		t.Fatal(diff)
+	}
+
+	m := maps[1]
+	for _, test := range []struct {
+		name      string
+		got, want int
+	}{
+		{"ByteOffset(2)", m.ByteOffset(2), 3},
+		{"ByteOffset(past end)", m.ByteOffset(100), 15},
+		{"RuneColumn(2)", m.RuneColumn(2), 1},
+		{"RuneColumn(9)", m.RuneColumn(9), 4},
+		{"GraphemeColumn(1)", m.GraphemeColumn(1), 0},
+		{"GraphemeColumn(5)", m.GraphemeColumn(5), 2},
+		{"RuneColumnOfGrapheme(2)", m.RuneColumnOfGrapheme(2), 3},
+	} {
+		if test.got != test.want {
+			t.Errorf("%s = %d, want %d", test.name, test.got, test.want)
+		}
+	}
+}
+
+func TestCodeAsLinesWithColumns(t *testing.T) {
+	lines, maps, _, err := CodeAsLinesWithColumns(context.Background(), Params{
+		Content:   []byte("aé\r\nb\r\n"),
+		Filepath:  "a.txt",
+		Plaintext: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2", len(lines))
+	}
+	want := []ColumnMap{
+		{Runes: []int{0, 1, 3}, Graphemes: []int{0, 1, 2}},
+		{Runes: []int{0, 1}, Graphemes: []int{0, 1}},
+	}
+	if diff := cmp.Diff(want, maps); diff != "" {
+		t.Fatal(diff)
+	}
+}
@@ -0,0 +1,156 @@
+package highlight
+
+import (
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/inconshreveable/log15"
+	"github.com/sourcegraph/sourcegraph/internal/env"
+)
+
+// defaultLanguageDetectorOrder tries the default extension last, as it only
+// applies when syntect_server cannot determine a syntax from the file path
+// itself (see passthrough).
+const defaultLanguageDetectorOrder = "extension,shebang,content,passthrough,default"
+
+var languageDetectorOrder = env.Get("SRC_HIGHLIGHT_LANGUAGE_DETECTORS", defaultLanguageDetectorOrder, "comma-separated list of the language detection strategies used to choose a syntax for highlighting, in the order in which they are tried")
+
+// A LanguageDetector is a strategy for choosing the syntax used to highlight
+// a file. syntect_server chooses a syntax from the extension or name of the
+// file path it is given (or from a shebang line), so a detector resolves a
+// language by returning the file path to send to syntect_server.
+type LanguageDetector interface {
+	// DetectLanguage returns the file path to send to syntect_server to
+	// highlight code, and false if the detector cannot determine a language.
+	DetectLanguage(filepath, code string) (string, bool)
+}
+
+// LanguageDetectorFunc is an adapter to allow the use of ordinary functions as
+// a LanguageDetector.
+type LanguageDetectorFunc func(filepath, code string) (string, bool)
+
+// DetectLanguage implements LanguageDetector.
+func (f LanguageDetectorFunc) DetectLanguage(filepath, code string) (string, bool) {
+	return f(filepath, code)
+}
+
+var (
+	languageDetectorsMu sync.Mutex
+	languageDetectors   = map[string]LanguageDetector{
+		"extension":   LanguageDetectorFunc(detectByExtension),
+		"shebang":     LanguageDetectorFunc(detectByShebang),
+		"content":     LanguageDetectorFunc(detectByContent),
+		"passthrough": LanguageDetectorFunc(passthrough),
+		"default":     LanguageDetectorFunc(withDefaultExtension),
+	}
+	languageDetectorChain []namedDetector
+)
+
+// RegisterLanguageDetector registers a custom language detection strategy
+// under the given name. It is only used if the name is listed in
+// SRC_HIGHLIGHT_LANGUAGE_DETECTORS, and must be called before the first file
+// is highlighted (e.g. from an init function).
+func RegisterLanguageDetector(name string, d LanguageDetector) {
+	languageDetectorsMu.Lock()
+	defer languageDetectorsMu.Unlock()
+	languageDetectors[name] = d
+	languageDetectorChain = nil
+}
+
+type namedDetector struct {
+	name     string
+	detector LanguageDetector
+}
+
+// detectorChain returns the configured language detectors in order.
+func detectorChain() []namedDetector {
+	languageDetectorsMu.Lock()
+	defer languageDetectorsMu.Unlock()
+	if languageDetectorChain == nil {
+		languageDetectorChain = parseDetectorOrder(languageDetectorOrder, languageDetectors)
+	}
+	return languageDetectorChain
+}
+
+func parseDetectorOrder(order string, detectors map[string]LanguageDetector) []namedDetector {
+	chain := []namedDetector{}
+	for _, name := range strings.Split(order, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		d, ok := detectors[name]
+		if !ok {
+			log15.Warn("ignoring unknown language detector in SRC_HIGHLIGHT_LANGUAGE_DETECTORS", "name", name)
+			continue
+		}
+		chain = append(chain, namedDetector{name: name, detector: d})
+	}
+	return chain
+}
+
+// languageResolver runs a chain of language detectors for a file, yielding
+// each distinct file path to try in turn: if syntect_server cannot find a
+// syntax for one, the next detector in the chain gets a chance.
+type languageResolver struct {
+	chain          []namedDetector
+	filepath, code string
+	tried          map[string]bool
+}
+
+func newLanguageResolver(chain []namedDetector, filepath, code string) *languageResolver {
+	return &languageResolver{chain: chain, filepath: filepath, code: code, tried: map[string]bool{}}
+}
+
+// next returns the name of the next detector which resolves a language, and
+// the file path it resolved. It returns false when the chain is exhausted.
+func (r *languageResolver) next() (name, filepath string, ok bool) {
+	for len(r.chain) > 0 {
+		d := r.chain[0]
+		r.chain = r.chain[1:]
+		filepath, ok := d.detector.DetectLanguage(r.filepath, r.code)
+		if !ok || r.tried[filepath] {
+			continue
+		}
+		r.tried[filepath] = true
+		return d.name, filepath, true
+	}
+	return "", "", false
+}
+
+// detectByExtension resolves files which have an extension, or a file name
+// syntect_server is known to recognize (such as Makefile), to their own path.
+func detectByExtension(filepath, code string) (string, bool) {
+	name := path.Base(filepath)
+	if path.Ext(name) != "" || supportedExtensions[strings.ToLower(name)] {
+		return filepath, true
+	}
+	return "", false
+}
+
+// detectByShebang resolves files with a shebang line to their own path, as
+// syntect_server detects the syntax from the shebang line.
+func detectByShebang(filepath, code string) (string, bool) {
+	if strings.HasPrefix(code, "#!") {
+		return filepath, true
+	}
+	return "", false
+}
+
+// detectByContent resolves files whose language can be confidently guessed
+// from their content (see guessExtension).
+func detectByContent(filepath, code string) (string, bool) {
+	if ext, ok := guessExtension(code); ok {
+		return filepath + "." + ext, true
+	}
+	return "", false
+}
+
+// passthrough resolves every file to its own path, leaving it to
+// syntect_server to recognize the file by name (e.g. Jenkinsfile or
+// PKGBUILD, which are not in SyntectLanguageMap) or else render it as plain
+// text.
+func passthrough(filepath, code string) (string, bool) {
+	return filepath, true
+}
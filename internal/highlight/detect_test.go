@@ -0,0 +1,107 @@
+package highlight
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLanguageResolver(t *testing.T) {
+	orig := defaultExtension
+	t.Cleanup(func() { defaultExtension = orig })
+	defaultExtension = "sh"
+
+	chain := parseDetectorOrder(defaultLanguageDetectorOrder, languageDetectors)
+	tests := []struct {
+		filepath, code string
+		want           []string
+	}{
+		{filepath: "a.go", code: "package a", want: []string{"extension:a.go"}},
+		{filepath: "a/Makefile", code: "all:", want: []string{"extension:a/Makefile", "default:a/Makefile.sh"}},
+		// The shebang detector resolves the same path as the extension
+		// detector, so it is not tried again.
+		{filepath: "run.py", code: "#!/usr/bin/env python", want: []string{"extension:run.py"}},
+		{filepath: "bin/run", code: "#!/bin/sh", want: []string{"shebang:bin/run"}},
+		{filepath: "data.unknownext", code: `{"a": 1}`, want: []string{"extension:data.unknownext", "content:data.unknownext.json"}},
+		{filepath: "config", code: "<a></a>", want: []string{"content:config.xml", "passthrough:config", "default:config.sh"}},
+		{filepath: "bin/run", code: "echo hi", want: []string{"passthrough:bin/run", "default:bin/run.sh"}},
+		{filepath: "Jenkinsfile", code: "pipeline {}", want: []string{"passthrough:Jenkinsfile", "default:Jenkinsfile.sh"}},
+	}
+	for _, test := range tests {
+		r := newLanguageResolver(chain, test.filepath, test.code)
+		var got []string
+		for {
+			name, filepath, ok := r.next()
+			if !ok {
+				break
+			}
+			got = append(got, name+":"+filepath)
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("%s: %s", test.filepath, diff)
+		}
+	}
+
+	// Without the passthrough detector, files may resolve to no language.
+	defaultExtension = ""
+	r := newLanguageResolver(parseDetectorOrder("extension,shebang,content,default", languageDetectors), "LICENSE", "Permission is hereby granted")
+	if name, filepath, ok := r.next(); ok {
+		t.Errorf("got %s:%s, want no language", name, filepath)
+	}
+}
+
+func TestParseDetectorOrder(t *testing.T) {
+	custom := LanguageDetectorFunc(func(filepath, code string) (string, bool) { return filepath + ".rb", true })
+	detectors := map[string]LanguageDetector{"extension": LanguageDetectorFunc(detectByExtension), "custom": custom}
+
+	var got []string
+	for _, d := range parseDetectorOrder(" custom, unknown,,extension", detectors) {
+		got = append(got, d.name)
+	}
+	if diff := cmp.Diff([]string{"custom", "extension"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestCode_LanguageDetectors(t *testing.T) {
+	// A fake syntect_server which only knows the .json extension.
+	var (
+		mu      sync.Mutex
+		queried []string
+	)
+	withFakeSyntect(t, func(w http.ResponseWriter, r *http.Request) {
+		var q struct{ Filepath, Code string }
+		if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		queried = append(queried, q.Filepath)
+		mu.Unlock()
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"data":      "<pre>\n<span>" + q.Code + "</span></pre>",
+			"plaintext": !strings.HasSuffix(q.Filepath, ".json"),
+		})
+	})
+
+	for _, test := range []struct {
+		filepath, code string
+		want           []string
+	}{
+		{filepath: "data.unknownext", code: `{"a": 1}`, want: []string{"data.unknownext", "data.unknownext.json"}},
+		{filepath: "LICENSE", code: "Permission is hereby granted", want: []string{"LICENSE"}},
+	} {
+		queried = nil
+		if _, _, err := Code(context.Background(), Params{Content: []byte(test.code), Filepath: test.filepath}); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(test.want, queried); diff != "" {
+			t.Errorf("%s: %s", test.filepath, diff)
+		}
+	}
+}
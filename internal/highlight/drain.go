@@ -0,0 +1,65 @@
+package highlight
+
+import (
+	"context"
+	"sync"
+)
+
+// inFlight tracks highlight requests to syntect_server which are in progress,
+// so that they can be drained before the process shuts down.
+var inFlight struct {
+	sync.Mutex
+	n        int
+	draining bool
+	idle     chan struct{} // closed when draining and n drops to zero
+}
+
+// startRequest registers a new in-flight request. It returns false if the
+// package is draining, in which case no request should be made.
+func startRequest() bool {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	if inFlight.draining {
+		return false
+	}
+	inFlight.n++
+	return true
+}
+
+// finishRequest marks a request registered with startRequest as done.
+func finishRequest() {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	inFlight.n--
+	if inFlight.n == 0 && inFlight.idle != nil {
+		close(inFlight.idle)
+		inFlight.idle = nil
+	}
+}
+
+// Drain stops Code from sending new requests to syntect_server (files are
+// rendered as plain text instead) and blocks until all in-flight requests
+// have finished or ctx is done, in which case ctx.Err() is returned.
+//
+// It should be called during graceful shutdown, before the HTTP servers
+// serving highlight requests are closed.
+func Drain(ctx context.Context) error {
+	inFlight.Lock()
+	inFlight.draining = true
+	if inFlight.n == 0 {
+		inFlight.Unlock()
+		return nil
+	}
+	if inFlight.idle == nil {
+		inFlight.idle = make(chan struct{})
+	}
+	idle := inFlight.idle
+	inFlight.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
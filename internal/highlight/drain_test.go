@@ -0,0 +1,48 @@
+package highlight
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	t.Cleanup(func() {
+		inFlight.Lock()
+		inFlight.draining = false
+		inFlight.Unlock()
+	})
+
+	if !startRequest() {
+		t.Fatal("expected request to start before draining")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected Drain to time out with a request in flight, got %v", err)
+	}
+	if startRequest() {
+		t.Fatal("expected no new requests to start while draining")
+	}
+
+	finishRequest()
+	if err := Drain(context.Background()); err != nil {
+		t.Fatalf("expected Drain to succeed once requests finished, got %v", err)
+	}
+
+	// The timed out Drain must not leave anything waiting which breaks
+	// requests started after draining is reset (e.g. by another test).
+	inFlight.Lock()
+	inFlight.draining = false
+	inFlight.Unlock()
+	for i := 0; i < 3; i++ {
+		if !startRequest() {
+			t.Fatal("expected request to start after draining was reset")
+		}
+		finishRequest()
+	}
+	if err := Drain(context.Background()); err != nil {
+		t.Fatalf("expected Drain to succeed with no requests in flight, got %v", err)
+	}
+}
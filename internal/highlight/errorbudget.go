@@ -0,0 +1,139 @@
+package highlight
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sourcegraph/sourcegraph/internal/env"
+)
+
+var (
+	errorBudgetWindow, _    = time.ParseDuration(env.Get("SRC_HIGHLIGHT_ERROR_BUDGET_WINDOW", "5m", "window over which the syntax highlighting failure rate is computed"))
+	errorBudgetThreshold, _ = strconv.ParseFloat(env.Get("SRC_HIGHLIGHT_ERROR_BUDGET_THRESHOLD", "0.1", "failure rate (0-1) over the error budget window above which syntax highlighting is reported as degraded"), 64)
+)
+
+// errorBudgetMinRequests is the minimum number of requests in the window
+// before the failure rate is considered meaningful, so that e.g. a single
+// timeout on an idle instance does not report highlighting as degraded.
+const errorBudgetMinRequests = 20
+
+var metricFailureRate = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "src_syntax_highlighting_failure_rate",
+	Help: "Rate (0-1) of syntax highlighting requests which failed or timed out over the error budget window.",
+})
+
+var budget = newErrorBudget(errorBudgetWindow, errorBudgetThreshold)
+
+// observeErrorBudget records the outcome of a highlighting request with the
+// given requestCounter status.
+func observeErrorBudget(status string) {
+	var failed bool
+	switch status {
+	case "success", "generated", "plaintext", "no_language", "draining":
+	default:
+		failed = true
+	}
+	rate, alert := budget.observe(time.Now(), failed)
+	metricFailureRate.Set(rate)
+	if alert {
+		log15.Error("syntax highlighting is degraded", "failure_rate", rate, "threshold", budget.threshold, "window", budget.window)
+	}
+}
+
+// errorBudget tracks the failure rate of highlighting requests over a
+// sliding window and decides when it is worth alerting about.
+type errorBudget struct {
+	window    time.Duration
+	threshold float64
+
+	mu        sync.Mutex
+	counter   *slidingCounter
+	lastAlert time.Time
+}
+
+func newErrorBudget(window time.Duration, threshold float64) *errorBudget {
+	if window <= 0 {
+		window = 5 * time.Minute
+	}
+	return &errorBudget{
+		window:    window,
+		threshold: threshold,
+		counter:   newSlidingCounter(window, 10),
+	}
+}
+
+// observe records a request outcome at the given time. It returns the
+// failure rate over the window and whether an alert should be emitted, which
+// happens at most once per window while the rate exceeds the threshold.
+func (b *errorBudget) observe(now time.Time, failed bool) (rate float64, alert bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.counter.add(now, failed)
+	total, failures := b.counter.sum(now)
+	if total > 0 {
+		rate = float64(failures) / float64(total)
+	}
+	if total < errorBudgetMinRequests || rate <= b.threshold {
+		return rate, false
+	}
+	if !b.lastAlert.IsZero() && now.Sub(b.lastAlert) < b.window {
+		return rate, false
+	}
+	b.lastAlert = now
+	return rate, true
+}
+
+// slidingCounter counts totals and failures over a sliding window using a
+// fixed ring of buckets, so that memory use does not grow with traffic. It is
+// not safe for concurrent use.
+type slidingCounter struct {
+	bucketSize time.Duration
+	buckets    []counterBucket
+}
+
+type counterBucket struct {
+	start           time.Time
+	total, failures int
+}
+
+func newSlidingCounter(window time.Duration, numBuckets int) *slidingCounter {
+	// A window shorter than numBuckets nanoseconds would make the buckets
+	// empty, and dividing by their size panic.
+	bucketSize := window / time.Duration(numBuckets)
+	if bucketSize < 1 {
+		bucketSize = 1
+	}
+	return &slidingCounter{
+		bucketSize: bucketSize,
+		buckets:    make([]counterBucket, numBuckets),
+	}
+}
+
+func (c *slidingCounter) add(now time.Time, failed bool) {
+	start := now.Truncate(c.bucketSize)
+	b := &c.buckets[(start.UnixNano()/int64(c.bucketSize))%int64(len(c.buckets))]
+	if !b.start.Equal(start) {
+		*b = counterBucket{start: start}
+	}
+	b.total++
+	if failed {
+		b.failures++
+	}
+}
+
+func (c *slidingCounter) sum(now time.Time) (total, failures int) {
+	oldest := now.Truncate(c.bucketSize).Add(-c.bucketSize * time.Duration(len(c.buckets)-1))
+	for _, b := range c.buckets {
+		if b.start.Before(oldest) {
+			continue
+		}
+		total += b.total
+		failures += b.failures
+	}
+	return total, failures
+}
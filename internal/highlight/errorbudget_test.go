@@ -0,0 +1,89 @@
+package highlight
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlidingCounter(t *testing.T) {
+	c := newSlidingCounter(10*time.Second, 10)
+	start := time.Unix(1000, 0)
+
+	c.add(start, false)
+	c.add(start.Add(500*time.Millisecond), true)
+	c.add(start.Add(5*time.Second), true)
+	if total, failures := c.sum(start.Add(5 * time.Second)); total != 3 || failures != 2 {
+		t.Fatalf("got total=%d failures=%d, want total=3 failures=2", total, failures)
+	}
+
+	// Once the first bucket falls out of the window only the later request
+	// remains.
+	if total, failures := c.sum(start.Add(10 * time.Second)); total != 1 || failures != 1 {
+		t.Fatalf("got total=%d failures=%d, want total=1 failures=1", total, failures)
+	}
+
+	// A bucket which is reused after wrapping around the ring is reset.
+	c.add(start.Add(20*time.Second), false)
+	if total, failures := c.sum(start.Add(20 * time.Second)); total != 1 || failures != 0 {
+		t.Fatalf("got total=%d failures=%d, want total=1 failures=0", total, failures)
+	}
+}
+
+func TestSlidingCounter_TinyWindow(t *testing.T) {
+	c := newSlidingCounter(time.Nanosecond, 10)
+	start := time.Unix(1000, 0)
+
+	c.add(start, true)
+	if total, failures := c.sum(start); total != 1 || failures != 1 {
+		t.Fatalf("got total=%d failures=%d, want total=1 failures=1", total, failures)
+	}
+}
+
+func TestErrorBudget(t *testing.T) {
+	b := newErrorBudget(time.Minute, 0.5)
+	now := time.Unix(1000, 0)
+
+	var alerts int
+	observe := func(failed bool) float64 {
+		rate, alert := b.observe(now, failed)
+		if alert {
+			alerts++
+		}
+		return rate
+	}
+
+	// Failures below the minimum number of requests never alert.
+	for i := 0; i < errorBudgetMinRequests-1; i++ {
+		observe(true)
+	}
+	if alerts != 0 {
+		t.Fatalf("got %d alerts before reaching the minimum number of requests, want 0", alerts)
+	}
+
+	// Exceeding the threshold alerts exactly once per window.
+	for i := 0; i < 10; i++ {
+		if rate := observe(true); rate != 1 {
+			t.Fatalf("got rate %v, want 1", rate)
+		}
+	}
+	if alerts != 1 {
+		t.Fatalf("got %d alerts, want 1", alerts)
+	}
+
+	now = now.Add(time.Minute)
+	for i := 0; i < errorBudgetMinRequests; i++ {
+		observe(true)
+	}
+	if alerts != 2 {
+		t.Fatalf("got %d alerts after the window elapsed, want 2", alerts)
+	}
+
+	// A healthy window does not alert.
+	now = now.Add(2 * time.Minute)
+	for i := 0; i < 2*errorBudgetMinRequests; i++ {
+		observe(i%4 == 0)
+	}
+	if alerts != 2 {
+		t.Fatalf("got %d alerts while below the threshold, want 2", alerts)
+	}
+}
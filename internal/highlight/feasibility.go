@@ -0,0 +1,118 @@
+package highlight
+
+import (
+	"path"
+	"strconv"
+	"strings"
+)
+
+// maxFileSize is the maximum size in bytes of a file which CheckFeasibility
+// reports as feasible to highlight. Code does not enforce it: it only advises
+// clients whether to request highlighting at all. A value <= 0 disables the
+// limit.
+var maxFileSize = envInt("SRC_HIGHLIGHT_MAX_FILE_SIZE", 0, "maximum size in bytes of a file which clients are advised to request syntax highlighting for (<= 0 disables the limit)")
+
+// Feasibility is the verdict of CheckFeasibility.
+type Feasibility int
+
+const (
+	// Supported indicates that the file can likely be highlighted.
+	Supported Feasibility = iota
+
+	// TooLarge indicates that the file exceeds the configured maximum file
+	// size, so highlighting it is likely to be slow.
+	TooLarge
+
+	// Binary indicates that the file is binary and cannot be rendered (Code
+	// returns ErrBinary).
+	Binary
+
+	// UnsupportedExtension indicates that no syntax is known for the file,
+	// so it would be rendered as plain text.
+	UnsupportedExtension
+
+	// PlainText indicates that the file would be rendered as plain text
+	// regardless of its language: it is a plain text (.txt) file, matches
+	// a configured plain text path (Params.Plaintext), or is a generated or
+	// vendored file which is not highlighted.
+	PlainText
+)
+
+func (f Feasibility) String() string {
+	switch f {
+	case Supported:
+		return "supported"
+	case TooLarge:
+		return "too-large"
+	case Binary:
+		return "binary"
+	case UnsupportedExtension:
+		return "unsupported-extension"
+	case PlainText:
+		return "plain-text"
+	}
+	return "Feasibility(" + strconv.Itoa(int(f)) + ")"
+}
+
+// supportedExtensions is the set of lowercase file extensions and file names
+// which syntect_server is known to highlight, derived from
+// SyntectLanguageMap.
+var supportedExtensions = func() map[string]bool {
+	m := make(map[string]bool, 2*len(SyntectLanguageMap))
+	for name, ext := range SyntectLanguageMap {
+		m[name] = true
+		m[strings.ToLower(ext)] = true
+	}
+	return m
+}()
+
+// plainTextExtension is the extension of syntect_server's plain text syntax,
+// which does not highlight anything.
+const plainTextExtension = "txt"
+
+// CheckFeasibility cheaply determines whether p can be highlighted, without
+// sending a request to syntect_server, so that clients can decide whether
+// to request highlighting at all.
+//
+// The checks follow the order in which Code decides how to render a file.
+// The list of known extensions is not exhaustive, so UnsupportedExtension
+// may be returned for some files which syntect_server can highlight.
+func CheckFeasibility(p Params) Feasibility {
+	if IsBinary(p.Content) {
+		return Binary
+	}
+	if skipGenerated && !p.HighlightGenerated && IsGeneratedOrVendored(p.Filepath) {
+		return PlainText
+	}
+	if p.Plaintext {
+		return PlainText
+	}
+	if maxFileSize > 0 && len(p.Content) > maxFileSize {
+		return TooLarge
+	}
+	code := string(p.Content)
+	name := strings.ToLower(path.Base(p.Filepath))
+	ext := strings.TrimPrefix(path.Ext(name), ".")
+	switch {
+	case supportedExtensions[name] && name != plainTextExtension:
+		// A known file name such as CMakeLists.txt.
+		return Supported
+	case ext == plainTextExtension:
+		return PlainText
+	case supportedExtensions[ext]:
+		return Supported
+	case strings.HasPrefix(code, "#!"):
+		// syntect_server detects the syntax from the shebang line.
+		return Supported
+	}
+	if _, ok := guessExtension(code); ok {
+		return Supported
+	}
+	if filepath, ok := withDefaultExtension(p.Filepath, code); ok {
+		if path.Ext(filepath) == "."+plainTextExtension {
+			return PlainText
+		}
+		return Supported
+	}
+	return UnsupportedExtension
+}
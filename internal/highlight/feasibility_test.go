@@ -0,0 +1,54 @@
+package highlight
+
+import "testing"
+
+func TestCheckFeasibility(t *testing.T) {
+	orig := maxFileSize
+	maxFileSize = 100
+	defer func() { maxFileSize = orig }()
+	origSkip := skipGenerated
+	skipGenerated = true
+	defer func() { skipGenerated = origSkip }()
+
+	tests := []struct {
+		name string
+		p    Params
+		want Feasibility
+	}{
+		{name: "extension", p: Params{Filepath: "a/b.go", Content: []byte("package b")}, want: Supported},
+		{name: "upper case extension", p: Params{Filepath: "a/B.PY", Content: []byte("x = 1")}, want: Supported},
+		{name: "file name", p: Params{Filepath: "a/Makefile", Content: []byte("all:")}, want: Supported},
+		{name: "shebang", p: Params{Filepath: "bin/run", Content: []byte("#!/bin/sh\necho")}, want: Supported},
+		{name: "guessed", p: Params{Filepath: "data.unknownext", Content: []byte(`{"a": 1}`)}, want: Supported},
+		{name: "unsupported", p: Params{Filepath: "a.unknownext", Content: []byte("a")}, want: UnsupportedExtension},
+		{name: "binary", p: Params{Filepath: "a.go", Content: []byte{0xff, 0x00, 0x01, 0x02}}, want: Binary},
+		{name: "too large", p: Params{Filepath: "a.go", Content: make([]byte, 101)}, want: TooLarge},
+		{name: "plain text extension", p: Params{Filepath: "notes.txt", Content: []byte("a")}, want: PlainText},
+		{name: "plain text file name", p: Params{Filepath: "CMakeLists.txt", Content: []byte("project(a)")}, want: Supported},
+		{name: "plaintext path", p: Params{Filepath: "a.go", Content: []byte("package a"), Plaintext: true}, want: PlainText},
+		{name: "vendored", p: Params{Filepath: "vendor/a/a.go", Content: []byte("package a")}, want: PlainText},
+		{name: "vendored highlighted", p: Params{Filepath: "vendor/a/a.go", Content: []byte("package a"), HighlightGenerated: true}, want: Supported},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := CheckFeasibility(test.p); got != test.want {
+				t.Fatalf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckFeasibility_DefaultExtension(t *testing.T) {
+	orig := defaultExtension
+	t.Cleanup(func() { defaultExtension = orig })
+
+	p := Params{Filepath: "README", Content: []byte("a")}
+	defaultExtension = "sh"
+	if got := CheckFeasibility(p); got != Supported {
+		t.Fatalf("got %s, want %s", got, Supported)
+	}
+	defaultExtension = plainTextExtension
+	if got := CheckFeasibility(p); got != PlainText {
+		t.Fatalf("got %s, want %s", got, PlainText)
+	}
+}
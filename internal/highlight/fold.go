@@ -0,0 +1,93 @@
+package highlight
+
+import "strings"
+
+// foldRegions returns the foldable regions of code, determined by
+// indentation: a line starts a region if the following non-blank line is
+// indented further, and the region extends to the last non-blank line before
+// the indentation returns to (or below) that of the starting line. This works
+// reasonably well for most languages without any knowledge of their syntax.
+//
+// The result maps the (1-based) first line of each region to its last line.
+func foldRegions(code string) map[int]int {
+	type open struct{ line, indent int }
+	var (
+		folds     = map[int]int{}
+		stack     []open
+		lastLine  int // last non-blank line
+		closeOpen = func(indent int) {
+			for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+				start := stack[len(stack)-1].line
+				stack = stack[:len(stack)-1]
+				if lastLine > start {
+					folds[start] = lastLine
+				}
+			}
+		}
+	)
+	for i, line := range strings.Split(code, "\n") {
+		indent, blank := indentation(line, defaultTabWidth)
+		if blank {
+			continue
+		}
+		closeOpen(indent)
+		stack = append(stack, open{line: i + 1, indent: indent})
+		lastLine = i + 1
+	}
+	closeOpen(0)
+	return folds
+}
+
+// defaultTabWidth is the tab width used when none is configured. It matches
+// the tab-size used by the frontend to display code.
+const defaultTabWidth = 4
+
+// indentation returns the width in columns of the leading whitespace of line,
+// with tab stops every tabWidth columns, and whether the line is blank.
+func indentation(line string, tabWidth int) (width int, blank bool) {
+	for _, r := range line {
+		switch r {
+		case ' ':
+			width++
+		case '\t':
+			width = (width/tabWidth + 1) * tabWidth
+		case '\r':
+		default:
+			return width, false
+		}
+	}
+	return width, true
+}
+
+// indentLevels returns the number of indentation levels (multiples of
+// tabWidth columns of leading whitespace) of each line of code. Blank lines
+// take the lesser level of the surrounding non-blank lines, so that
+// indentation guides are not interrupted by blank lines within a block.
+func indentLevels(code string, tabWidth int) []int {
+	lines := strings.Split(code, "\n")
+	levels := make([]int, len(lines))
+	blank := make([]bool, len(lines))
+	for i, line := range lines {
+		var width int
+		width, blank[i] = indentation(line, tabWidth)
+		levels[i] = width / tabWidth
+	}
+	// Blank lines take the lesser of the previous and next non-blank levels.
+	next := 0
+	for i := len(lines) - 1; i >= 0; i-- {
+		if blank[i] {
+			levels[i] = next
+		} else {
+			next = levels[i]
+		}
+	}
+	prev := 0
+	for i := range lines {
+		if !blank[i] {
+			prev = levels[i]
+		} else if prev < levels[i] {
+			levels[i] = prev
+		}
+	}
+	return levels
+}
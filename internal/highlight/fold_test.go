@@ -0,0 +1,136 @@
+package highlight
+
+import (
+	"context"
+	"html/template"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFoldRegions(t *testing.T) {
+	code := `package main
+
+func main() {
+	if true {
+		println("a")
+
+	}
+	println("b")
+}
+
+func f() {}
+type T struct {
+    A int
+}
+`
+	want := map[int]int{
+		3:  8,  // func main
+		4:  5,  // if true
+		12: 13, // type T
+	}
+	if diff := cmp.Diff(want, foldRegions(code)); diff != "" {
+		t.Fatalf("unexpected fold regions (-want +got):\n%s", diff)
+	}
+}
+
+func TestTables_FoldRegions(t *testing.T) {
+	code := "a {\n\tb\n}"
+	opt := Params{FoldRegions: true}.tableOptions(code)
+
+	plain, err := generatePlainTable(code, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<table><tr data-fold-end="2"><td class="line" data-line="1"></td><td class="code"><span>a {</span></td></tr><tr><td class="line" data-line="2"></td><td class="code"><span>	b</span></td></tr><tr><td class="line" data-line="3"></td><td class="code"><span>}</span></td></tr></table>`
+	if string(plain) != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", plain, want)
+	}
+
+	highlighted, _, err := preSpansToTable("<pre>\n<span>a {\n</span><span>\tb\n</span><span>}</span></pre>", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `<table><tr data-fold-end="2"><td class="line" data-line="1"></td><td class="code"><div><span>a {
+</span></div></td></tr><tr><td class="line" data-line="2"></td><td class="code"><div><span>	b
+</span></div></td></tr><tr><td class="line" data-line="3"></td><td class="code"><div><span>}</span></div></td></tr></table>`
+	if highlighted != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", highlighted, want)
+	}
+}
+
+func TestIndentLevels(t *testing.T) {
+	code := "a\n\tb\n\n  \t\tc\n\n\n    d\ne"
+	want := []int{0, 1, 1, 2, 1, 1, 1, 0}
+	if diff := cmp.Diff(want, indentLevels(code, 4)); diff != "" {
+		t.Fatalf("unexpected indent levels (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]int{0, 2, 0, 0}, indentLevels("a\n    b\n\nc", 2)); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestTables_IndentGuides(t *testing.T) {
+	code := "a\n\t\tb"
+	opt := Params{IndentGuides: true}.tableOptions(code)
+
+	plain, err := generatePlainTable(code, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<table><tr><td class="line" data-line="1"></td><td class="code"><span>a</span></td></tr><tr><td class="line" data-line="2"></td><td class="code"><span class="indent-guide" style="left:0ch"></span><span class="indent-guide" style="left:4ch"></span><span>		b</span></td></tr></table>`
+	if string(plain) != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", plain, want)
+	}
+
+	highlighted, _, err := preSpansToTable("<pre>\n<span>a\n</span><span>\t\t</span><span style=\"color:#aaa;\">b</span></pre>", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `<table><tr><td class="line" data-line="1"></td><td class="code"><div><span>a
+</span></div></td></tr><tr><td class="line" data-line="2"></td><td class="code"><div><span class="indent-guide" style="left:0ch"></span><span class="indent-guide" style="left:4ch"></span><span>		</span><span style="color:#aaa;">b</span></div></td></tr></table>`
+	if highlighted != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", highlighted, want)
+	}
+
+	// The guides do not change the text of the code.
+	if text, err := Plaintext(template.HTML(highlighted)); err != nil || text != code {
+		t.Fatalf("got %q (error %v), want %q", text, err, code)
+	}
+}
+
+func TestCodeAsLines_IndentGuidesPlain(t *testing.T) {
+	lines, _, err := CodeAsLines(context.Background(), Params{
+		Content:      []byte("a\n\tb\n"),
+		Filepath:     "a.txt",
+		Plaintext:    true,
+		IndentGuides: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []template.HTML{
+		`<span>a</span>`,
+		`<span class="indent-guide" style="left:0ch"></span><span>	b</span>`,
+	}
+	if diff := cmp.Diff(want, lines); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestUnhighlightLongLines_IndentGuides(t *testing.T) {
+	opt := Params{IndentGuides: true}.tableOptions("\tbb")
+	highlighted, _, err := preSpansToTable("<pre>\n<span>\t</span><span style=\"color:#aaa;\">bb</span></pre>", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := unhighlightLongLines(highlighted, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<table><tbody><tr><td class="line" data-line="1"></td><td class="code"><div><span class="indent-guide" style="left:0ch"></span><span>	bb</span></div></td></tr></tbody></table>`
+	if got != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", got, want)
+	}
+}
@@ -0,0 +1,72 @@
+package highlight
+
+import (
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/sourcegraph/sourcegraph/internal/env"
+)
+
+var (
+	skipGenerated, _ = strconv.ParseBool(env.Get("SRC_HIGHLIGHT_SKIP_GENERATED", "false", "render vendored and generated files as plain text instead of highlighting them"))
+
+	generatedPatterns = parseGeneratedPatterns(env.Get(
+		"SRC_HIGHLIGHT_GENERATED_PATTERNS",
+		"*.pb.go,*.pb.gw.go,*_pb2.py,*.min.js,*.min.css,*.js.map,*_generated.go,zz_generated.*,package-lock.json,yarn.lock",
+		"comma-separated glob patterns of generated files which are rendered as plain text (patterns without a slash match the file name only)",
+	))
+)
+
+// parseGeneratedPatterns parses a comma-separated list of glob patterns,
+// dropping empty and invalid ones.
+func parseGeneratedPatterns(s string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(s, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// vendorDirs are the names of directories whose contents are vendored.
+var vendorDirs = map[string]bool{
+	"vendor":       true,
+	"node_modules": true,
+}
+
+// IsGeneratedOrVendored reports whether the file at the given path is
+// vendored (inside a vendor/ or node_modules/ directory) or matches one of the
+// configured generated file patterns.
+func IsGeneratedOrVendored(filepath string) bool {
+	dirs := strings.Split(path.Dir(filepath), "/")
+	for _, dir := range dirs {
+		if vendorDirs[dir] {
+			return true
+		}
+	}
+	return MatchesPathPattern(generatedPatterns, filepath)
+}
+
+// MatchesPathPattern reports whether filepath matches any of the glob
+// patterns. Patterns containing a slash are matched against the full path,
+// all other patterns against the file name.
+func MatchesPathPattern(patterns []string, filepath string) bool {
+	name := path.Base(filepath)
+	for _, pattern := range patterns {
+		target := name
+		if strings.Contains(pattern, "/") {
+			target = filepath
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package highlight
+
+import "testing"
+
+func TestIsGeneratedOrVendored(t *testing.T) {
+	tests := map[string]bool{
+		"main.go":                         false,
+		"cmd/server/main.go":              false,
+		"vendor/github.com/pkg/errors.go": true,
+		"web/node_modules/react/index.js": true,
+		"api/service.pb.go":               true,
+		"dist/app.min.js":                 true,
+		"yarn.lock":                       true,
+		"pkg/zz_generated.deepcopy.go":    true,
+		"vendor":                          false,
+		".gitignore":                      false,
+		"gradlew":                         false,
+		"third_party/lib/a.c":             false,
+		"dist/app.js":                     false,
+	}
+	for filepath, want := range tests {
+		if got := IsGeneratedOrVendored(filepath); got != want {
+			t.Errorf("IsGeneratedOrVendored(%q) = %v, want %v", filepath, got, want)
+		}
+	}
+}
+
+func TestMatchesGeneratedPattern(t *testing.T) {
+	patterns := parseGeneratedPatterns(" *.gen.go, ,[invalid,gen/*.ts")
+	if want := []string{"*.gen.go", "gen/*.ts"}; len(patterns) != len(want) || patterns[0] != want[0] || patterns[1] != want[1] {
+		t.Fatalf("got patterns %q, want %q", patterns, want)
+	}
+	tests := map[string]bool{
+		"a/b/foo.gen.go": true,
+		"foo.go":         false,
+		"gen/types.ts":   true,
+		"src/gen/a.ts":   false,
+	}
+	for filepath, want := range tests {
+		if got := MatchesPathPattern(patterns, filepath); got != want {
+			t.Errorf("MatchesPathPattern(%q) = %v, want %v", filepath, got, want)
+		}
+	}
+}
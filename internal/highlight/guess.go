@@ -0,0 +1,64 @@
+package highlight
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// guessExtension returns the file extension of the language that code is
+// written in, if it can be determined with high confidence from the content
+// alone. It is used for files whose extension syntect_server does not know.
+//
+// The checks are deliberately conservative: the content must parse
+// successfully as a whole, as mis-highlighting is worse than no highlighting.
+func guessExtension(code string) (string, bool) {
+	trimmed := strings.TrimSpace(code)
+	if trimmed == "" {
+		return "", false
+	}
+	switch trimmed[0] {
+	case '{', '[':
+		if json.Valid([]byte(trimmed)) {
+			return "json", true
+		}
+	case '<':
+		if isXML(trimmed) {
+			return "xml", true
+		}
+	}
+	return "", false
+}
+
+// isXML reports whether s is a well-formed XML document with a root element.
+func isXML(s string) bool {
+	d := xml.NewDecoder(strings.NewReader(s))
+	var (
+		depth int
+		roots int
+	)
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return roots == 1 && depth == 0
+		}
+		if err != nil {
+			return false
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				roots++
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			if depth == 0 && len(strings.TrimSpace(string(tok))) > 0 {
+				// Text outside of the root element.
+				return false
+			}
+		}
+	}
+}
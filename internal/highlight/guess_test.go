@@ -0,0 +1,31 @@
+package highlight
+
+import "testing"
+
+func TestGuessExtension(t *testing.T) {
+	tests := []struct {
+		name, code string
+		want       string
+	}{
+		{name: "JSON object", code: "{\n  \"name\": \"sourcegraph\",\n  \"private\": true\n}\n", want: "json"},
+		{name: "JSON array", code: "  [1, 2, {\"a\": null}]", want: "json"},
+		{name: "XML with declaration", code: "<?xml version=\"1.0\"?>\n<project><name>x</name></project>\n", want: "xml"},
+		{name: "XML without declaration", code: "<config>\n  <!-- comment -->\n  <item key=\"a\"/>\n</config>", want: "xml"},
+
+		{name: "empty", code: "  \n"},
+		{name: "invalid JSON", code: "{ name: sourcegraph }"},
+		{name: "shell block", code: "{ echo a; echo b; }"},
+		{name: "unclosed XML", code: "<config><item></config>"},
+		{name: "multiple XML roots", code: "<a></a><b></b>"},
+		{name: "text after XML root", code: "<a></a> trailing"},
+		{name: "plain text", code: "hello world"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := guessExtension(test.code)
+			if got != test.want || ok != (test.want != "") {
+				t.Fatalf("guessExtension(%q) = %q, %v, want %q", test.code, got, ok, test.want)
+			}
+		})
+	}
+}
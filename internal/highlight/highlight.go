@@ -5,8 +5,14 @@ import (
 	"context"
 	"fmt"
 	"html/template"
+	"io"
 	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode/utf8"
 
@@ -24,12 +30,53 @@ import (
 )
 
 var (
-	syntectServer = env.Get("SRC_SYNTECT_SERVER", "http://syntect-server:9238", "syntect_server HTTP(s) address")
-	client        *gosyntect.Client
+	syntectServer = env.Get("SRC_SYNTECT_SERVER", "http://syntect-server:9238", "syntect_server HTTP(s) address, or a comma-separated list of addresses to load-balance across")
+	client        *serverPool
 )
 
+// envInt returns the integer value of the environment variable name,
+// registering it with env.Get. An invalid value is logged and def is used
+// instead.
+func envInt(name string, def int, description string) int {
+	return parseEnvInt(name, env.Get(name, strconv.Itoa(def), description), def)
+}
+
+func parseEnvInt(name, value string, def int) int {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log15.Error("highlight: invalid integer environment variable, using the default", "name", name, "value", value, "default", def, "error", err)
+		return def
+	}
+	return n
+}
+
+// defaultExtension is the file extension used to highlight files which have
+// no extension (and no shebang) and for which syntect_server cannot otherwise
+// determine a syntax. It is empty (disabled) by default.
+var defaultExtension = strings.TrimPrefix(env.Get("SRC_HIGHLIGHT_DEFAULT_EXTENSION", "", "file extension (e.g. sh) used to highlight files without an extension when no syntax can otherwise be determined"), ".")
+
+// maxSpanDepth is the maximum nesting depth of <span> elements in
+// syntect_server's output which is preserved in highlighted tables. Deeper
+// spans are flattened into their closest preserved ancestor.
+var maxSpanDepth = envInt("SRC_HIGHLIGHT_MAX_SPAN_DEPTH", 8, "maximum nesting depth of highlighted spans which is preserved (deeper spans are flattened into their parent)")
+
+// maxRows is the maximum number of rows rendered per highlighted file. Any
+// further lines are omitted and a truncation row is rendered in their place.
+// A value <= 0 disables the limit. RawHTML output and the lines returned by
+// CodeAsLines are never truncated, as callers index them by line number.
+var maxRows = envInt("SRC_HIGHLIGHT_MAX_ROWS", 500000, "maximum number of lines rendered per highlighted file, further lines are replaced by a truncation marker (<= 0 disables the limit)")
+
+// highlightTimeout is how long Code waits for syntect_server, unless
+// Params.DisableTimeout is set.
+const highlightTimeout = 3 * time.Second
+
+// maxResponseSize is the maximum size in bytes of highlighted HTML we accept
+// from syntect_server. Larger responses are rendered as plain text instead.
+// A value <= 0 disables the limit.
+var maxResponseSize = envInt("SRC_SYNTECT_MAX_RESPONSE_SIZE", 64<<20, "maximum size in bytes of a syntect_server response before falling back to plain text (<= 0 disables the limit)")
+
 func init() {
-	client = gosyntect.New(syntectServer)
+	client = newServerPool(syntectServer)
 }
 
 // IsBinary is a helper to tell if the content of a file is binary or not.
@@ -67,12 +114,134 @@ type Params struct {
 	// rendering efficiently.
 	HighlightLongLines bool
 
+	// HighlightGenerated, if true, highlights vendored and generated files
+	// (see IsGeneratedOrVendored) even if the deployment is configured to
+	// render them as plain text.
+	HighlightGenerated bool
+
+	// Plaintext, if true, renders the file as plain text without
+	// highlighting it, e.g. because it matches a configured path which
+	// should never be highlighted.
+	Plaintext bool
+
+	// RawHTML, if true, returns syntect_server's highlighted <pre> HTML
+	// as-is instead of converting it into a table, for clients which do their
+	// own DOM manipulation. Plain text fallbacks are likewise rendered as a
+	// <pre> element, and HighlightLongLines and FixedLineNumberWidth have no
+	// effect.
+	RawHTML bool
+
+	// FixedLineNumberWidth, if true, reserves a fixed width for the line
+	// number column based on the total number of lines (e.g. 3 characters
+	// for a file with 100-999 lines), so that the code column does not shift
+	// as line numbers gain digits (e.g. when rows are rendered incrementally).
+	FixedLineNumberWidth bool
+
+	// LineNumberWindow, if non-zero, omits the line numbers (the data-line
+	// attribute) of rows outside of the window to reduce the size of the
+	// DOM for very large files of which only a part is visible. The line
+	// number cells and their anchors (see LineAnchors) are kept.
+	LineNumberWindow LineRange
+
+	// LineAnchors, if true, gives the line number cell of each row an id of
+	// the form "L42", so that browsers can navigate directly to a line (e.g.
+	// via a #L42 fragment).
+	LineAnchors bool
+
+	// LineNumberHref, if non-empty, is a URL template (e.g.
+	// "/repo/-/blob/file.go#L{line}") in which "{line}" is replaced by the
+	// line number of each row. The line number cell of each row then
+	// contains a link to that URL with the line number as its text. Only
+	// relative, http and https URLs are allowed; otherwise it is ignored.
+	LineNumberHref string
+
+	// RowClasses, if non-nil, maps (1-based) line numbers to a class added to
+	// the row of that line, e.g. to mark lines which changed since an earlier
+	// revision (see AddedLines).
+	RowClasses map[int]string
+
+	// HeaderRows, if non-zero, is the range of rows (e.g. the first line of
+	// a CSV file) which are marked with the "header" class, in addition to
+	// any class from RowClasses.
+	HeaderRows LineRange
+
+	// FoldRegions, if true, marks the first row of each foldable region
+	// (determined by indentation) with a data-fold-end attribute holding the
+	// line number of the region's last line, so that the frontend can
+	// collapse it.
+	FoldRegions bool
+
+	// ApplyHooks, if true, applies the hooks registered with RegisterHook to
+	// the highlighted code. Hooks are not applied to RawHTML output.
+	ApplyHooks bool
+
+	// IndentGuides, if true, adds an empty <span class="indent-guide"> at the
+	// start of each row for every level of leading indentation, so that the
+	// frontend can draw vertical indentation guides. Each guide is
+	// positioned with an inline left offset in characters.
+	IndentGuides bool
+
+	// TabWidth is the tab width used to compute indentation levels. The
+	// default is 4, the tab-size used by the frontend to display code.
+	TabWidth int
+
+	// ThemeBackground, if true, gives the table of highlighted code the base
+	// background color of the theme (from syntect_server's <pre> element),
+	// so that plain rows (e.g. after a partial highlighting fallback) have
+	// the same background as highlighted ones. Plain text tables (e.g. after
+	// a timeout) get the background color syntect_server last returned for
+	// the theme, or none if it has not highlighted anything with the theme
+	// yet.
+	ThemeBackground bool
+
+	// Grid, if true, renders <div> elements with ARIA table roles (e.g.
+	// <div role="row">) instead of <table>, <tr> and <td> elements, for
+	// embedding contexts which lay out code with CSS grid. The class and
+	// data attributes are the same as in the default table.
+	Grid bool
+
 	// Whether or not to simulate the syntax highlighter taking too long to
 	// respond.
 	SimulateTimeout bool
 
 	// Metadata provides optional metadata about the code we're highlighting.
 	Metadata Metadata
+
+	// QueryOptions provides optional overrides for the query sent to
+	// syntect_server.
+	QueryOptions QueryOptions
+
+	// allRows, if true, disables the SRC_HIGHLIGHT_MAX_ROWS limit. It is set
+	// by CodeAsLines.
+	allRows bool
+}
+
+// QueryOptions contains optional overrides for the query sent to
+// syntect_server, allowing callers to experiment with syntect_server features
+// without changing the Params defaults. Zero values leave the defaults in
+// place.
+type QueryOptions struct {
+	// Theme overrides the theme selected via Params.IsLightTheme. It must be
+	// one of syntect_server's embedded themes, see
+	// https://github.com/sourcegraph/syntect_server#embedded-themes
+	Theme string
+
+	// StabilizeTimeout overrides the syntect_server worker timeout chosen
+	// based on Params.DisableTimeout.
+	StabilizeTimeout time.Duration
+}
+
+// LineRange is a range of 1-based line numbers, including both Start and End.
+type LineRange struct {
+	Start, End int
+}
+
+// IsZero reports whether r is the zero range.
+func (r LineRange) IsZero() bool { return r == LineRange{} }
+
+// Contains reports whether line is within r.
+func (r LineRange) Contains(line int) bool {
+	return line >= r.Start && line <= r.End
 }
 
 // Metadata contains metadata about a request to highlight code. It is used to
@@ -105,12 +274,16 @@ func Code(ctx context.Context, p Params) (h template.HTML, aborted bool, err err
 	requestTime := prometheus.NewTimer(metricRequestHistogram)
 	tr, ctx := trace.New(ctx, "highlight.Code", "")
 	defer func() {
-		if prometheusStatus != "" {
-			requestCounter.WithLabelValues(prometheusStatus).Inc()
-		} else if err != nil {
-			requestCounter.WithLabelValues("error").Inc()
-		} else {
-			requestCounter.WithLabelValues("success").Inc()
+		status := prometheusStatus
+		if status == "" {
+			status = "success"
+			if err != nil {
+				status = "error"
+			}
+		}
+		requestCounter.WithLabelValues(status).Inc()
+		if err != ErrBinary {
+			observeErrorBudget(status)
 		}
 		tr.SetError(err)
 		tr.Finish()
@@ -119,7 +292,7 @@ func Code(ctx context.Context, p Params) (h template.HTML, aborted bool, err err
 
 	if !p.DisableTimeout {
 		var cancel func()
-		ctx, cancel = context.WithTimeout(ctx, 3*time.Second)
+		ctx, cancel = context.WithTimeout(ctx, highlightTimeout)
 		defer cancel()
 	}
 	if p.SimulateTimeout {
@@ -130,22 +303,26 @@ func Code(ctx context.Context, p Params) (h template.HTML, aborted bool, err err
 	if IsBinary(p.Content) {
 		return "", false, ErrBinary
 	}
-	code := string(p.Content)
 
-	themechoice := "Sourcegraph"
-	if p.IsLightTheme {
-		themechoice = "Sourcegraph (light)"
-	}
-
-	// Trim a single newline from the end of the file. This means that a file
-	// "a\n\n\n\n" will show line numbers 1-4 rather than 1-5, i.e. no blank
-	// line will be shown at the end of the file corresponding to the last
-	// newline.
+	// Normalize CRLF line endings, so that rows are numbered the same way
+	// git numbers lines, and then trim a single newline from the end of the
+	// file. This means that a file "a\n\n\n\n" will show line numbers 1-4
+	// rather than 1-5, i.e. no blank line will be shown at the end of the
+	// file corresponding to the last newline.
 	//
 	// This matches other online code reading tools such as e.g. GitHub; see
 	// https://github.com/sourcegraph/sourcegraph/issues/8024 for more
 	// background.
-	code = strings.TrimSuffix(code, "\n")
+	code := codeText(p.Content)
+
+	// Protect the frontend from rendering enormous tables (and syntect_server
+	// from highlighting lines which would not be shown anyway).
+	var truncatedLines int
+	if !p.RawHTML && !p.allRows {
+		code, truncatedLines = truncateLines(code, maxRows)
+	}
+	opt := p.tableOptions(code)
+	opt.truncatedLines = truncatedLines
 
 	// Tracing so we can identify problematic syntax highlighting requests.
 	tr.LogFields(
@@ -155,6 +332,43 @@ func Code(ctx context.Context, p Params) (h template.HTML, aborted bool, err err
 		otlog.String("snippet", fmt.Sprintf("%q…", firstCharacters(code, 10))),
 	)
 
+	// Vendored and generated files are large and rarely read in detail, so
+	// by default we do not spend syntect_server resources on them.
+	if skipGenerated && !p.HighlightGenerated && IsGeneratedOrVendored(p.Filepath) {
+		tr.LogFields(otlog.Bool("generated", true))
+		prometheusStatus = "generated"
+		table, err := generatePlain(code, p, opt)
+		return table, false, err
+	}
+
+	if p.Plaintext {
+		tr.LogFields(otlog.Bool("plaintext", true))
+		prometheusStatus = "plaintext"
+		table, err := generatePlain(code, p, opt)
+		return table, false, err
+	}
+
+	// Resolve the file path to send to syntect_server (which chooses the
+	// syntax from it) using the configured language detectors.
+	languages := newLanguageResolver(detectorChain(), p.Filepath, code)
+	detector, queryPath, ok := languages.next()
+	if !ok {
+		tr.LogFields(otlog.Bool("no_language", true))
+		prometheusStatus = "no_language"
+		metricPlaintextFallbacks.WithLabelValues(extensionLabel(p.Filepath)).Inc()
+		table, err := generatePlain(code, p, opt)
+		return table, false, err
+	}
+
+	// During shutdown, do not start new requests to syntect_server.
+	if !startRequest() {
+		tr.LogFields(otlog.Bool("draining", true))
+		prometheusStatus = "draining"
+		table, err := generatePlain(code, p, opt)
+		return table, true, err
+	}
+	defer finishRequest()
+
 	var stabilizeTimeout time.Duration
 	if p.DisableTimeout {
 		// The user wants to wait longer for results, so the default 10s worker
@@ -164,16 +378,37 @@ func Code(ctx context.Context, p Params) (h template.HTML, aborted bool, err err
 		// CPU for 30s.
 		stabilizeTimeout = 30 * time.Second
 	}
+	if p.QueryOptions.StabilizeTimeout != 0 {
+		stabilizeTimeout = p.QueryOptions.StabilizeTimeout
+	}
 
-	resp, err := client.Highlight(ctx, &gosyntect.Query{
+	query := &gosyntect.Query{
 		Code:             code,
-		Filepath:         p.Filepath,
-		Theme:            themechoice,
+		Filepath:         queryPath,
+		Theme:            p.theme(),
 		StabilizeTimeout: stabilizeTimeout,
 		Tracer:           ot.GetTracer(ctx),
-	})
+	}
+	tr.LogFields(otlog.String("language_detector", detector), otlog.String("query_filepath", queryPath))
+	resp, err := highlightShared(ctx, query)
+	for err == nil && resp.Plaintext {
+		// syntect_server could not find a syntax for the file, so give the
+		// next detector in the chain a chance.
+		detector, queryPath, ok = languages.next()
+		if !ok {
+			break
+		}
+		tr.LogFields(otlog.String("language_detector", detector), otlog.String("query_filepath", queryPath))
+		query.Filepath = queryPath
+		resp, err = highlightShared(ctx, query)
+	}
+	if err == nil && resp.Plaintext {
+		metricPlaintextFallbacks.WithLabelValues(extensionLabel(p.Filepath)).Inc()
+	}
 
-	if ctx.Err() == context.DeadlineExceeded {
+	// A request shared with other callers (see highlightShared) can time out
+	// before ctx does.
+	if ctx.Err() == context.DeadlineExceeded || errors.Is(err, context.DeadlineExceeded) {
 		log15.Warn(
 			"syntax highlighting took longer than 3s, this *could* indicate a bug in Sourcegraph",
 			"filepath", p.Filepath,
@@ -185,7 +420,7 @@ func Code(ctx context.Context, p Params) (h template.HTML, aborted bool, err err
 		prometheusStatus = "timeout"
 
 		// Timeout, so render plain table.
-		table, err2 := generatePlainTable(code)
+		table, err2 := generatePlain(code, p, opt)
 		return table, true, err2
 	} else if err != nil {
 		log15.Error(
@@ -213,16 +448,76 @@ func Code(ctx context.Context, p Params) (h template.HTML, aborted bool, err err
 			// user an error.
 			tr.LogFields(otlog.Bool(problem, true))
 			prometheusStatus = problem
-			table, err2 := generatePlainTable(code)
+			table, err2 := generatePlain(code, p, opt)
 			return table, false, err2
 		}
 		return "", false, err
 	}
+	if maxResponseSize > 0 && len(resp.Data) > maxResponseSize {
+		// A misbehaving syntect_server could return an enormous response; do
+		// not parse it into a table but render plain text instead.
+		log15.Warn(
+			"syntax highlighting response exceeded the maximum size, rendering plain text instead",
+			"filepath", p.Filepath,
+			"repo_name", p.Metadata.RepoName,
+			"revision", p.Metadata.Revision,
+			"size", len(resp.Data),
+			"max_size", maxResponseSize,
+		)
+		tr.LogFields(otlog.Bool("response_too_large", true))
+		prometheusStatus = "response_too_large"
+		table, err2 := generatePlain(code, p, opt)
+		return table, false, err2
+	}
+
+	if mangledResponse(resp.Data, code) {
+		// A misbehaving syntect_server could return bytes which are not
+		// valid UTF-8, which would be mangled when parsed into a table.
+		log15.Warn(
+			"syntax highlighting response is not valid UTF-8, rendering plain text instead",
+			"filepath", p.Filepath,
+			"repo_name", p.Metadata.RepoName,
+			"revision", p.Metadata.Revision,
+			"snippet", fmt.Sprintf("%q…", firstCharacters(code, 80)),
+		)
+		tr.LogFields(otlog.Bool("invalid_utf8", true))
+		prometheusStatus = "invalid_utf8"
+		table, err2 := generatePlain(code, p, opt)
+		return table, false, err2
+	}
+
 	// Note: resp.Data is properly HTML escaped by syntect_server
-	table, err := preSpansToTable(resp.Data)
+	if p.RawHTML {
+		return template.HTML(resp.Data), false, nil
+	}
+
+	// Building the table is CPU-bound, so limit how many builds run
+	// concurrently. If we cannot start before the deadline, render plain
+	// text instead.
+	release, ok := acquireTableBuild(ctx)
+	if !ok {
+		tr.LogFields(otlog.Bool("table_build_timeout", true))
+		prometheusStatus = "table_build_timeout"
+		table, err2 := generatePlain(code, p, opt)
+		return table, true, err2
+	}
+	defer release()
+
+	table, partial, err := preSpansToTable(resp.Data, opt)
 	if err != nil {
 		return "", false, err
 	}
+	if partial {
+		log15.Warn(
+			"syntax highlighting produced unexpected HTML, rendering remainder as plain text",
+			"filepath", p.Filepath,
+			"repo_name", p.Metadata.RepoName,
+			"revision", p.Metadata.Revision,
+			"snippet", fmt.Sprintf("%q…", firstCharacters(code, 80)),
+		)
+		tr.LogFields(otlog.Bool("partial", true))
+		prometheusStatus = "partial"
+	}
 	if !p.HighlightLongLines {
 		// This number was arbitrarily chosen. We don't want long lines in general to be unhighlighted,
 		// but if there are super long lines OR many lines of near this length we don't want it to slow
@@ -236,6 +531,50 @@ func Code(ctx context.Context, p Params) (h template.HTML, aborted bool, err err
 	return template.HTML(table), false, nil
 }
 
+// mangledResponse reports whether the syntect_server response data for code
+// is not valid UTF-8. gosyntect decodes responses as JSON, which replaces
+// invalid UTF-8 with U+FFFD, so replacement characters which do not appear in
+// code are also treated as invalid.
+func mangledResponse(data, code string) bool {
+	if !utf8.ValidString(data) {
+		return true
+	}
+	return strings.ContainsRune(data, utf8.RuneError) && !strings.ContainsRune(code, utf8.RuneError)
+}
+
+// WriteCode is like Code, but writes the highlighted table to w wrapped in a
+// container element carrying the file path and revision as data attributes:
+//
+// 	<div class="highlighted-code" data-filepath="..." data-revision="...">
+// 	<table>...</table>
+// 	</div>
+//
+// This lets callers composing a larger page embed highlighted code without
+// splicing strings.
+func WriteCode(ctx context.Context, w io.Writer, p Params) (aborted bool, err error) {
+	table, aborted, err := Code(ctx, p)
+	if err != nil {
+		return aborted, err
+	}
+	_, err = fmt.Fprintf(w, `<div class="highlighted-code" data-filepath="%s" data-revision="%s">%s</div>`,
+		html.EscapeString(p.Filepath),
+		html.EscapeString(p.Metadata.Revision),
+		table,
+	)
+	return aborted, err
+}
+
+// withDefaultExtension returns filepath with the configured default extension
+// appended, if one is configured and the file has neither an extension nor a
+// shebang line (which syntect_server uses to detect the syntax). It is the
+// "default" language detector.
+func withDefaultExtension(filepath, code string) (string, bool) {
+	if defaultExtension == "" || path.Ext(path.Base(filepath)) != "" || strings.HasPrefix(code, "#!") {
+		return "", false
+	}
+	return filepath + "." + defaultExtension, true
+}
+
 // TODO (Dax): Determine if Histogram provides value and either use only histogram or counter, not both
 var requestCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "src_syntax_highlighting_requests",
@@ -248,6 +587,25 @@ var metricRequestHistogram = promauto.NewHistogram(
 		Help: "time for a request to have syntax highlight",
 	})
 
+var metricPlaintextFallbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "src_syntax_highlighting_plaintext_fallbacks",
+	Help: "Counts files rendered as plain text because syntect_server found no syntax for them, by file extension.",
+}, []string{"extension"})
+
+// extensionLabel returns the metric label for the extension of filepath. To
+// bound the label's cardinality, unusually long extensions are grouped as
+// "other", and files without an extension are labeled "none".
+func extensionLabel(filepath string) string {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(path.Base(filepath)), "."))
+	switch {
+	case ext == "":
+		return "none"
+	case len(ext) > 8:
+		return "other"
+	}
+	return ext
+}
+
 func firstCharacters(s string, n int) string {
 	v := []rune(s)
 	if len(v) < n {
@@ -256,6 +614,323 @@ func firstCharacters(s string, n int) string {
 	return string(v[:n])
 }
 
+// tableOptions configures how the table builders (preSpansToTable and
+// generatePlainTable) render rows. The zero value renders the default table.
+type tableOptions struct {
+	// lineNumberWidth, if non-zero, is the width in characters reserved for
+	// line numbers.
+	lineNumberWidth int
+
+	// lineNumberWindow, if non-zero, is the range of rows which have line
+	// numbers.
+	lineNumberWindow LineRange
+
+	// lineAnchors, if true, adds an id="L{n}" anchor to line number cells.
+	lineAnchors bool
+
+	// lineNumberHref, if non-empty, is the URL template of the line number
+	// links (see Params.LineNumberHref).
+	lineNumberHref string
+
+	// rowClasses maps line numbers to row classes.
+	rowClasses map[int]string
+
+	// folds, if non-nil, maps the first line of each foldable region to its
+	// last line.
+	folds map[int]int
+
+	// hooks are applied to the text of each token.
+	hooks []Hook
+
+	// indentGuides, if non-nil, holds the indentation level of each row.
+	indentGuides []int
+	tabWidth     int
+
+	// truncatedLines, if non-zero, is the number of lines omitted after the
+	// last row, for which a truncation row is rendered.
+	truncatedLines int
+
+	// grid, if true, renders <div> elements in place of table elements (see
+	// Params.Grid).
+	grid bool
+
+	// themeBackground, if true, applies the theme's background color to the
+	// table (see Params.ThemeBackground).
+	themeBackground bool
+
+	// theme is the name of the syntect_server theme used for highlighting.
+	theme string
+}
+
+// tableOptions returns the table options for highlighting code with p.
+func (p Params) tableOptions(code string) tableOptions {
+	var opt tableOptions
+	if p.FixedLineNumberWidth {
+		opt.lineNumberWidth = len(strconv.Itoa(strings.Count(code, "\n") + 1))
+	}
+	opt.lineNumberWindow = p.LineNumberWindow
+	opt.rowClasses = p.RowClasses
+	if !p.HeaderRows.IsZero() {
+		opt.rowClasses = withHeaderRows(p.RowClasses, p.HeaderRows, strings.Count(code, "\n")+1)
+	}
+	opt.lineAnchors = p.LineAnchors
+	if validLineNumberHref(p.LineNumberHref) {
+		opt.lineNumberHref = p.LineNumberHref
+	}
+	if p.FoldRegions {
+		opt.folds = foldRegions(code)
+	}
+	if p.ApplyHooks {
+		opt.hooks = registeredHooks
+	}
+	if p.IndentGuides {
+		opt.tabWidth = p.TabWidth
+		if opt.tabWidth <= 0 {
+			opt.tabWidth = defaultTabWidth
+		}
+		opt.indentGuides = indentLevels(code, opt.tabWidth)
+	}
+	opt.grid = p.Grid
+	opt.themeBackground = p.ThemeBackground
+	opt.theme = p.theme()
+	return opt
+}
+
+// theme returns the name of the syntect_server theme to highlight with.
+func (p Params) theme() string {
+	if p.QueryOptions.Theme != "" {
+		return p.QueryOptions.Theme
+	}
+	if p.IsLightTheme {
+		return "Sourcegraph (light)"
+	}
+	return "Sourcegraph"
+}
+
+// withHeaderRows returns a copy of rowClasses in which the header rows of a
+// file with n rows also have the "header" class.
+func withHeaderRows(rowClasses map[int]string, header LineRange, n int) map[int]string {
+	classes := make(map[int]string, len(rowClasses)+1)
+	for row, class := range rowClasses {
+		classes[row] = class
+	}
+	for row := header.Start; row <= header.End && row <= n; row++ {
+		if row < 1 {
+			continue
+		}
+		if class, ok := classes[row]; ok {
+			classes[row] = class + " header"
+		} else {
+			classes[row] = "header"
+		}
+	}
+	return classes
+}
+
+// rowAttrs returns the attributes of the given row (1-based).
+func rowAttrs(row int, opt tableOptions) []html.Attribute {
+	var attrs []html.Attribute
+	if class, ok := opt.rowClasses[row]; ok {
+		attrs = append(attrs, html.Attribute{Key: "class", Val: class})
+	}
+	if end, ok := opt.folds[row]; ok {
+		attrs = append(attrs, html.Attribute{Key: "data-fold-end", Val: strconv.Itoa(end)})
+	}
+	return attrs
+}
+
+// indentGuideAttrs returns the attributes of the indentation guides of the
+// given row (1-based).
+func indentGuideAttrs(row int, opt tableOptions) [][]html.Attribute {
+	if row > len(opt.indentGuides) {
+		return nil
+	}
+	guides := make([][]html.Attribute, opt.indentGuides[row-1])
+	for i := range guides {
+		guides[i] = []html.Attribute{
+			{Key: "class", Val: "indent-guide"},
+			{Key: "style", Val: "left:" + strconv.Itoa(i*opt.tabWidth) + "ch"},
+		}
+	}
+	return guides
+}
+
+// isIndentGuide reports whether n is an indentation guide (see
+// indentGuideAttrs).
+func isIndentGuide(n *html.Node) bool {
+	if n.Type != html.ElementNode || n.DataAtom != atom.Span {
+		return false
+	}
+	for _, a := range n.Attr {
+		if a.Key == "class" && a.Val == "indent-guide" {
+			return true
+		}
+	}
+	return false
+}
+
+// truncateLines returns the first max lines of code, and the number of lines
+// omitted. If max <= 0, code is returned as-is.
+func truncateLines(code string, max int) (string, int) {
+	if max <= 0 {
+		return code, 0
+	}
+	i := 0
+	for n := 0; n < max; n++ {
+		j := strings.IndexByte(code[i:], '\n')
+		if j < 0 {
+			return code, 0
+		}
+		i += j + 1
+	}
+	return code[:i-1], strings.Count(code[i:], "\n") + 1
+}
+
+// truncationClass is the class of the row rendered in place of lines omitted
+// because of the maximum number of rows.
+const truncationClass = "truncated"
+
+// truncationText returns the text of the truncation row.
+func truncationText(lines int) string {
+	return "… " + strconv.Itoa(lines) + " more lines not shown"
+}
+
+// truncationRowAttrs returns the attributes of the truncation row.
+func truncationRowAttrs(lines int) []html.Attribute {
+	return []html.Attribute{
+		{Key: "class", Val: truncationClass},
+		{Key: "data-truncated-lines", Val: strconv.Itoa(lines)},
+	}
+}
+
+// isTruncationRow reports whether the table row n is a truncation row.
+func isTruncationRow(n *html.Node) bool {
+	for _, a := range n.Attr {
+		if a.Key == "data-truncated-lines" {
+			return true
+		}
+	}
+	return false
+}
+
+// gridRoles maps table elements to the ARIA roles of the <div> elements which
+// replace them in grid mode.
+var gridRoles = map[atom.Atom]string{
+	atom.Table: "table",
+	atom.Tr:    "row",
+	atom.Td:    "cell",
+}
+
+// element returns the element and attributes to render in place of the table
+// element a (table, tr or td) with the given attributes.
+func (opt tableOptions) element(a atom.Atom, attrs []html.Attribute) (atom.Atom, []html.Attribute) {
+	if !opt.grid {
+		return a, attrs
+	}
+	return atom.Div, append([]html.Attribute{{Key: "role", Val: gridRoles[a]}}, attrs...)
+}
+
+// newElement returns a node for the table element a (see element).
+func (opt tableOptions) newElement(a atom.Atom, attrs []html.Attribute) *html.Node {
+	a, attrs = opt.element(a, attrs)
+	return &html.Node{Type: html.ElementNode, DataAtom: a, Data: a.String(), Attr: attrs}
+}
+
+// writeStart writes the start tag of the table element a (see element) to
+// buf.
+func (opt tableOptions) writeStart(buf *strings.Builder, a atom.Atom, attrs []html.Attribute) {
+	a, attrs = opt.element(a, attrs)
+	buf.WriteByte('<')
+	buf.WriteString(a.String())
+	writeAttrs(buf, attrs)
+	buf.WriteByte('>')
+}
+
+// writeEnd writes the end tag of the table element a (see element) to buf.
+func (opt tableOptions) writeEnd(buf *strings.Builder, a atom.Atom) {
+	a, _ = opt.element(a, nil)
+	buf.WriteString("</")
+	buf.WriteString(a.String())
+	buf.WriteByte('>')
+}
+
+// codeCellAttrs are the attributes of the code cell of each row.
+var codeCellAttrs = []html.Attribute{{Key: "class", Val: "code"}}
+
+// lineNumberAttrs returns the attributes of the line number cell of the given
+// row (1-based).
+func lineNumberAttrs(row int, opt tableOptions) []html.Attribute {
+	attrs := []html.Attribute{{Key: "class", Val: "line"}}
+	if opt.lineNumberWindow.IsZero() || opt.lineNumberWindow.Contains(row) {
+		attrs = append(attrs, html.Attribute{Key: "data-line", Val: strconv.Itoa(row)})
+	}
+	if opt.lineNumberWidth > 0 {
+		attrs = append(attrs, html.Attribute{Key: "style", Val: "min-width:" + strconv.Itoa(opt.lineNumberWidth) + "ch"})
+	}
+	if opt.lineAnchors {
+		attrs = append(attrs, html.Attribute{Key: "id", Val: "L" + strconv.Itoa(row)})
+	}
+	return attrs
+}
+
+// validLineNumberHref reports whether the URL template tmpl may be used for
+// line number links.
+func validLineNumberHref(tmpl string) bool {
+	if tmpl == "" {
+		return false
+	}
+	u, err := url.Parse(lineNumberHref(tmpl, 1))
+	return err == nil && (u.Scheme == "" || u.Scheme == "http" || u.Scheme == "https")
+}
+
+// lineNumberHref returns the URL of the line number link of the given row.
+func lineNumberHref(tmpl string, row int) string {
+	return strings.ReplaceAll(tmpl, "{line}", strconv.Itoa(row))
+}
+
+// backgroundColorPattern matches the background color in the style attribute
+// of syntect_server's <pre> element. Only hex colors are accepted, so that
+// the style cannot inject other CSS.
+var backgroundColorPattern = regexp.MustCompile(`(?:^|;)\s*background-color:\s*(#[0-9a-fA-F]{3,8})\s*(?:;|$)`)
+
+// themeBackgrounds maps the name of a theme to the background color of the
+// last <pre> element syntect_server returned for it, for styling plain text
+// tables, which are rendered without asking syntect_server.
+var themeBackgrounds sync.Map
+
+// tableAttrs returns the attributes of the table built from syntect_server's
+// <pre> element.
+func tableAttrs(pre *html.Node, opt tableOptions) []html.Attribute {
+	for _, a := range pre.Attr {
+		if a.Key != "style" {
+			continue
+		}
+		if m := backgroundColorPattern.FindStringSubmatch(a.Val); m != nil {
+			if opt.theme != "" {
+				themeBackgrounds.Store(opt.theme, m[1])
+			}
+			return backgroundAttrs(m[1], opt)
+		}
+	}
+	return nil
+}
+
+// plainTableAttrs returns the attributes of a plain text table.
+func plainTableAttrs(opt tableOptions) []html.Attribute {
+	color, ok := themeBackgrounds.Load(opt.theme)
+	if !ok {
+		return nil
+	}
+	return backgroundAttrs(color.(string), opt)
+}
+
+func backgroundAttrs(color string, opt tableOptions) []html.Attribute {
+	if !opt.themeBackground {
+		return nil
+	}
+	return []html.Attribute{{Key: "style", Val: "background-color:" + color}}
+}
+
 // preSpansToTable takes the syntect data structure, which looks like:
 //
 // 	<pre>
@@ -276,81 +951,168 @@ func firstCharacters(s string, n int) string {
 // 	</tr>
 // 	</table>
 //
-func preSpansToTable(h string) (string, error) {
+// In grid mode, <div> elements with ARIA roles are used in place of the table
+// elements.
+//
+// If an unexpected HTML structure is encountered partway through, the rows
+// produced so far are kept and the remaining content is rendered as plain
+// text rows. In this case partial is true.
+func preSpansToTable(h string, opt tableOptions) (table string, partial bool, err error) {
 	doc, err := html.Parse(strings.NewReader(h))
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 
 	body := doc.FirstChild.LastChild // html->body
 	pre := body.FirstChild
 	if pre == nil || pre.Type != html.ElementNode || pre.DataAtom != atom.Pre {
-		return "", fmt.Errorf("expected html->body->pre, found %+v", pre)
+		return "", false, fmt.Errorf("expected html->body->pre, found %+v", pre)
 	}
 
-	// We will walk over all of the <span> elements and add them to an existing
-	// code cell td, creating a new code cell td each time a newline is
-	// encountered.
+	// We will walk over all of the <span> elements and write them into the
+	// current code cell, starting a new table row each time a newline is
+	// encountered. The output is written directly rather than built as an
+	// html.Node tree and rendered, which avoids allocating a node per cell.
 	var (
-		table    = &html.Node{Type: html.ElementNode, DataAtom: atom.Table, Data: atom.Table.String()}
-		next     = pre.FirstChild // span or TextNode
-		rows     int
-		codeCell *html.Node
+		buf       strings.Builder
+		next      = pre.FirstChild // span or TextNode
+		rows      int
+		cellEmpty bool
 	)
+	buf.Grow(len(h) * 2)
+	opt.writeStart(&buf, atom.Table, tableAttrs(pre, opt))
+	endRow := func() {
+		buf.WriteString("</div>")
+		opt.writeEnd(&buf, atom.Td)
+		opt.writeEnd(&buf, atom.Tr)
+	}
 	newRow := func() {
-		// If the previous row did not have any children, then it was a blank
-		// line. Blank lines always need a span with a newline character for
-		// proper whitespace copy+paste support.
-		if codeCell != nil && codeCell.FirstChild == nil {
-			span := &html.Node{Type: html.ElementNode, DataAtom: atom.Span, Data: atom.Span.String()}
-			codeCell.AppendChild(span)
-			spanText := &html.Node{Type: html.TextNode, Data: "\n"}
-			span.AppendChild(spanText)
+		if rows > 0 {
+			// If the previous row did not have any children, then it was a
+			// blank line. Blank lines always need a span with a newline
+			// character for proper whitespace copy+paste support.
+			if cellEmpty {
+				buf.WriteString("<span>\n</span>")
+			}
+			endRow()
 		}
-
 		rows++
-		tr := &html.Node{Type: html.ElementNode, DataAtom: atom.Tr, Data: atom.Tr.String()}
-		table.AppendChild(tr)
-
-		tdLineNumber := &html.Node{Type: html.ElementNode, DataAtom: atom.Td, Data: atom.Td.String()}
-		tdLineNumber.Attr = append(tdLineNumber.Attr, html.Attribute{Key: "class", Val: "line"})
-		tdLineNumber.Attr = append(tdLineNumber.Attr, html.Attribute{Key: "data-line", Val: fmt.Sprint(rows)})
-		tr.AppendChild(tdLineNumber)
-		codeTd := &html.Node{Type: html.ElementNode, DataAtom: atom.Td, Data: atom.Td.String()}
-		tr.AppendChild(codeTd)
-		codeCell = &html.Node{Type: html.ElementNode, DataAtom: atom.Div, Data: atom.Div.String()}
-		codeTd.AppendChild(codeCell)
-		codeTd.Attr = append(codeCell.Attr, html.Attribute{Key: "class", Val: "code"})
+		opt.writeStart(&buf, atom.Tr, rowAttrs(rows, opt))
+		opt.writeStart(&buf, atom.Td, lineNumberAttrs(rows, opt))
+		if opt.lineNumberHref != "" {
+			buf.WriteString("<a")
+			writeAttrs(&buf, []html.Attribute{{Key: "href", Val: lineNumberHref(opt.lineNumberHref, rows)}})
+			buf.WriteString(">" + strconv.Itoa(rows) + "</a>")
+		}
+		opt.writeEnd(&buf, atom.Td)
+		opt.writeStart(&buf, atom.Td, codeCellAttrs)
+		buf.WriteString("<div>")
+		for _, attrs := range indentGuideAttrs(rows, opt) {
+			buf.WriteString("<span")
+			writeAttrs(&buf, attrs)
+			buf.WriteString("></span>")
+		}
+		cellEmpty = true
+	}
+	// appendPlain renders the text of n and all of its following siblings as
+	// plain text spans, creating a new table row for each newline.
+	appendPlain := func(n *html.Node) {
+		var text strings.Builder
+		for ; n != nil; n = n.NextSibling {
+			appendText(&text, n)
+		}
+		for _, line := range strings.SplitAfter(text.String(), "\n") {
+			if line == "" {
+				continue
+			}
+			buf.WriteString("<span>")
+			writeSegments(&buf, applyHooks(opt.hooks, line))
+			buf.WriteString("</span>")
+			cellEmpty = false
+			if strings.HasSuffix(line, "\n") {
+				newRow()
+			}
+		}
 	}
 	newRow()
+
+	// Spans may be nested (up to maxSpanDepth levels are preserved). The
+	// spans on the stack are open in the current row if openInRow ==
+	// len(stack); after a newline they are closed and lazily reopened in the
+	// next row, so that every row contains well-formed HTML.
+	var (
+		stack     []*html.Node
+		openInRow int
+	)
+	reopen := func() {
+		for ; openInRow < len(stack); openInRow++ {
+			buf.WriteString("<span")
+			writeAttrs(&buf, stack[openInRow].Attr)
+			buf.WriteByte('>')
+		}
+	}
+	writeText := func(text string) {
+		for text != "" {
+			line := text
+			if i := strings.IndexByte(text, '\n'); i >= 0 {
+				line = text[:i+1]
+			}
+			text = text[len(line):]
+
+			reopen()
+			if len(opt.hooks) > 0 {
+				writeSegments(&buf, applyHooks(opt.hooks, line))
+			} else {
+				buf.WriteString(escapeHTML(line))
+			}
+			cellEmpty = false
+			if strings.HasSuffix(line, "\n") {
+				for ; openInRow > 0; openInRow-- {
+					buf.WriteString("</span>")
+				}
+				newRow()
+			}
+		}
+	}
+	var writeSpan func(n *html.Node, depth int)
+	writeSpan = func(n *html.Node, depth int) {
+		push := depth <= maxSpanDepth || depth == 1
+		if push {
+			stack = append(stack, n)
+			reopen()
+			cellEmpty = false
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.TextNode {
+				writeText(c.Data)
+			} else {
+				writeSpan(c, depth+1)
+			}
+		}
+		if push {
+			if openInRow == len(stack) {
+				buf.WriteString("</span>")
+				openInRow--
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+
+loop:
 	for next != nil {
-		nextSibling := next.NextSibling
 		switch {
 		case next.Type == html.ElementNode && next.DataAtom == atom.Span:
-			// Found a span, so add it to our current code cell td.
-			next.Parent = nil
-			next.PrevSibling = nil
-			next.NextSibling = nil
-			codeCell.AppendChild(next)
-
-			// Scan the children for text nodes containing new lines so that we
-			// can create new table rows.
-			if next.FirstChild != nil {
-				nextChild := next.FirstChild
-				for nextChild != nil {
-					switch {
-					case nextChild.Type == html.TextNode:
-						// Text node, create a new table row for each newline.
-						newlines := strings.Count(nextChild.Data, "\n")
-						for i := 0; i < newlines; i++ {
-							newRow()
-						}
-					default:
-						return "", fmt.Errorf("unexpected HTML child structure (encountered %+v)", nextChild)
-					}
-					nextChild = nextChild.NextSibling
-				}
+			if !isSpanTree(next) {
+				// Unexpected HTML child structure, render this span and
+				// everything after it as plain text.
+				partial = true
+				appendPlain(next)
+				break loop
 			}
+
+			// Found a span, so add it to our current code cell, creating a
+			// new table row for each newline.
+			writeSpan(next, 1)
 		case next.Type == html.TextNode:
 			// Text node, create a new table row for each newline.
 			newlines := strings.Count(next.Data, "\n")
@@ -358,42 +1120,163 @@ func preSpansToTable(h string) (string, error) {
 				newRow()
 			}
 		default:
-			return "", fmt.Errorf("unexpected HTML structure (encountered %+v)", next)
+			// Unexpected HTML structure, render this node and everything
+			// after it as plain text.
+			partial = true
+			appendPlain(next)
+			break loop
 		}
-		next = nextSibling
+		next = next.NextSibling
+	}
+	endRow()
+	if opt.truncatedLines > 0 {
+		opt.writeStart(&buf, atom.Tr, truncationRowAttrs(opt.truncatedLines))
+		opt.writeStart(&buf, atom.Td, []html.Attribute{{Key: "class", Val: "line"}})
+		opt.writeEnd(&buf, atom.Td)
+		opt.writeStart(&buf, atom.Td, codeCellAttrs)
+		buf.WriteString("<div><span>")
+		buf.WriteString(escapeHTML(truncationText(opt.truncatedLines)))
+		buf.WriteString("</span></div>")
+		opt.writeEnd(&buf, atom.Td)
+		opt.writeEnd(&buf, atom.Tr)
 	}
+	opt.writeEnd(&buf, atom.Table)
+	return buf.String(), partial, nil
+}
 
-	var buf bytes.Buffer
-	if err := html.Render(&buf, table); err != nil {
-		return "", err
+// isSpanTree reports whether n is a <span> element whose descendants are all
+// <span> elements or text nodes.
+func isSpanTree(n *html.Node) bool {
+	if n.Type != html.ElementNode || n.DataAtom != atom.Span {
+		return false
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.TextNode && !isSpanTree(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeAttrs writes attrs to buf the same way html.Render would.
+func writeAttrs(buf *strings.Builder, attrs []html.Attribute) {
+	for _, a := range attrs {
+		buf.WriteByte(' ')
+		if a.Namespace != "" {
+			buf.WriteString(a.Namespace)
+			buf.WriteByte(':')
+		}
+		buf.WriteString(a.Key)
+		buf.WriteString(`="`)
+		buf.WriteString(escapeHTML(a.Val))
+		buf.WriteByte('"')
 	}
-	return buf.String(), nil
 }
 
-func generatePlainTable(code string) (template.HTML, error) {
-	table := &html.Node{Type: html.ElementNode, DataAtom: atom.Table, Data: atom.Table.String()}
-	for row, line := range strings.Split(code, "\n") {
-		line = strings.TrimSuffix(line, "\r") // CRLF files
+// htmlEscaper escapes text the same way html.Render does. Unlike
+// html.EscapeString, it also escapes "\r", which HTML parsers would
+// otherwise read as a line break.
+var htmlEscaper = strings.NewReplacer(
+	`&`, "&amp;",
+	`'`, "&#39;",
+	`<`, "&lt;",
+	`>`, "&gt;",
+	`"`, "&#34;",
+	"\r", "&#13;",
+)
+
+// escapeHTML escapes s for use in text or a quoted attribute value.
+func escapeHTML(s string) string {
+	return htmlEscaper.Replace(s)
+}
+
+// appendText appends the text content of n and its descendants to b.
+func appendText(b *strings.Builder, n *html.Node) {
+	if n.Type == html.TextNode {
+		b.WriteString(n.Data)
+		return
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		appendText(b, c)
+	}
+}
+
+// crlfPattern matches CRLF line endings, including any further CRs before
+// them (so that normalizing is idempotent).
+var crlfPattern = regexp.MustCompile(`\r+\n`)
+
+// normalizeNewlines converts CRLF line endings in s to LF. A lone CR does not
+// end a line: git, and so diffs, blame, links to lines and search results,
+// only split lines on LF, and rows must match their line numbers.
+func normalizeNewlines(s string) string {
+	if !strings.Contains(s, "\r") {
+		return s
+	}
+	return crlfPattern.ReplaceAllString(s, "\n")
+}
+
+// codeText returns the text which Code highlights for the given file
+// contents: with normalized line endings, without the final newline and with
+// secrets redacted.
+func codeText(content []byte) string {
+	return redactCode(strings.TrimSuffix(normalizeNewlines(string(content)), "\n"))
+}
+
+// generatePlain renders code as plain text in the format requested by p: a
+// table, or a <pre> element if p.RawHTML is set.
+func generatePlain(code string, p Params, opt tableOptions) (template.HTML, error) {
+	if p.RawHTML {
+		return generatePlainPre(code), nil
+	}
+	return generatePlainTable(code, opt)
+}
+
+// generatePlainPre renders code as a <pre> element, matching the structure of
+// syntect_server's raw output.
+func generatePlainPre(code string) template.HTML {
+	// A newline directly after <pre> is ignored by HTML parsers, so always
+	// emit one to preserve a leading blank line in code.
+	return template.HTML("<pre>\n" + escapeHTML(normalizeNewlines(code)) + "</pre>")
+}
+
+func generatePlainTable(code string, opt tableOptions) (template.HTML, error) {
+	table := opt.newElement(atom.Table, plainTableAttrs(opt))
+	for row, line := range strings.Split(normalizeNewlines(code), "\n") {
 		if line == "" {
 			line = "\n" // important for e.g. selecting whitespace in the produced table
 		}
-		tr := &html.Node{Type: html.ElementNode, DataAtom: atom.Tr, Data: atom.Tr.String()}
+		tr := opt.newElement(atom.Tr, rowAttrs(row+1, opt))
 		table.AppendChild(tr)
 
-		tdLineNumber := &html.Node{Type: html.ElementNode, DataAtom: atom.Td, Data: atom.Td.String()}
-		tdLineNumber.Attr = append(tdLineNumber.Attr, html.Attribute{Key: "class", Val: "line"})
-		tdLineNumber.Attr = append(tdLineNumber.Attr, html.Attribute{Key: "data-line", Val: fmt.Sprint(row + 1)})
+		tdLineNumber := opt.newElement(atom.Td, lineNumberAttrs(row+1, opt))
 		tr.AppendChild(tdLineNumber)
+		if opt.lineNumberHref != "" {
+			a := &html.Node{Type: html.ElementNode, DataAtom: atom.A, Data: atom.A.String(), Attr: []html.Attribute{{Key: "href", Val: lineNumberHref(opt.lineNumberHref, row+1)}}}
+			a.AppendChild(&html.Node{Type: html.TextNode, Data: strconv.Itoa(row + 1)})
+			tdLineNumber.AppendChild(a)
+		}
 
-		codeCell := &html.Node{Type: html.ElementNode, DataAtom: atom.Td, Data: atom.Td.String()}
-		codeCell.Attr = append(codeCell.Attr, html.Attribute{Key: "class", Val: "code"})
+		codeCell := opt.newElement(atom.Td, codeCellAttrs)
 		tr.AppendChild(codeCell)
+		for _, attrs := range indentGuideAttrs(row+1, opt) {
+			codeCell.AppendChild(&html.Node{Type: html.ElementNode, DataAtom: atom.Span, Data: atom.Span.String(), Attr: attrs})
+		}
 
 		// Span to match same structure as what highlighting would usually generate.
 		span := &html.Node{Type: html.ElementNode, DataAtom: atom.Span, Data: atom.Span.String()}
 		codeCell.AppendChild(span)
-		spanText := &html.Node{Type: html.TextNode, Data: line}
-		span.AppendChild(spanText)
+		appendSegments(span, applyHooks(opt.hooks, line))
+	}
+
+	if opt.truncatedLines > 0 {
+		tr := opt.newElement(atom.Tr, truncationRowAttrs(opt.truncatedLines))
+		table.AppendChild(tr)
+		tr.AppendChild(opt.newElement(atom.Td, []html.Attribute{{Key: "class", Val: "line"}}))
+		codeCell := opt.newElement(atom.Td, codeCellAttrs)
+		tr.AppendChild(codeCell)
+		span := &html.Node{Type: html.ElementNode, DataAtom: atom.Span, Data: atom.Span.String()}
+		codeCell.AppendChild(span)
+		span.AppendChild(&html.Node{Type: html.TextNode, Data: truncationText(opt.truncatedLines)})
 	}
 
 	var buf bytes.Buffer
@@ -412,33 +1295,27 @@ func generatePlainTable(code string) (template.HTML, error) {
 //
 // See https://github.com/sourcegraph/sourcegraph/issues/6489
 func unhighlightLongLines(h string, n int) (string, error) {
-	doc, err := html.Parse(strings.NewReader(h))
+	table, tr, err := parseTable(h)
 	if err != nil {
 		return "", err
 	}
 
-	table := doc.FirstChild.LastChild.FirstChild // html > body > table
-	if table == nil || table.Type != html.ElementNode || table.DataAtom != atom.Table {
-		return "", fmt.Errorf("expected html->body->table, found %+v", table)
-	}
-
 	// Iterate over each table row and check length
-	var buf bytes.Buffer
-	tr := table.FirstChild.FirstChild // table > tbody > tr
+	var buf strings.Builder
 	for tr != nil {
 		div := tr.LastChild.FirstChild // tr > td > div
-		span := div.FirstChild         // div > span
-		for span != nil {
-			node := span.FirstChild
-			for node != nil {
-				buf.WriteString(node.Data)
-				node = node.NextSibling
-			}
-			span = span.NextSibling
-		}
+		appendText(&buf, div)
 
-		// Length exceeds the limit, replace existing child with plain text
+		// Length exceeds the limit, replace existing children (except for
+		// indentation guides) with plain text
 		if buf.Len() > n {
+			for c := div.FirstChild; c != nil; {
+				next := c.NextSibling
+				if !isIndentGuide(c) {
+					div.RemoveChild(c)
+				}
+				c = next
+			}
 			span := &html.Node{
 				Type:     html.ElementNode,
 				DataAtom: atom.Span,
@@ -448,7 +1325,7 @@ func unhighlightLongLines(h string, n int) (string, error) {
 				Type: html.TextNode,
 				Data: buf.String(),
 			})
-			div.FirstChild = span
+			div.AppendChild(span)
 		}
 
 		buf.Reset()
@@ -464,12 +1341,31 @@ func unhighlightLongLines(h string, n int) (string, error) {
 	return buf.String(), nil
 }
 
+// parseTable parses a table produced by the table builders, in either the
+// default or grid layout, and returns its root element and first row.
+func parseTable(h string) (table, firstRow *html.Node, err error) {
+	doc, err := html.Parse(strings.NewReader(h))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	table = doc.FirstChild.LastChild.FirstChild // html > body > table
+	switch {
+	case table != nil && table.Type == html.ElementNode && table.DataAtom == atom.Table:
+		return table, table.FirstChild.FirstChild, nil // table > tbody > tr
+	case table != nil && table.Type == html.ElementNode && table.DataAtom == atom.Div:
+		return table, table.FirstChild, nil // div[role=table] > div[role=row]
+	}
+	return nil, nil, fmt.Errorf("expected html->body->table, found %+v", table)
+}
+
 // CodeAsLines highlights the file and returns a list of highlighted lines.
 // The returned boolean represents whether or not highlighting was aborted due
 // to timeout.
 //
 // In the event the input content is binary, ErrBinary is returned.
 func CodeAsLines(ctx context.Context, p Params) ([]template.HTML, bool, error) {
+	p.allRows = true
 	html, aborted, err := Code(ctx, p)
 	if err != nil {
 		return nil, aborted, err
@@ -478,35 +1374,130 @@ func CodeAsLines(ctx context.Context, p Params) ([]template.HTML, bool, error) {
 	return lines, aborted, err
 }
 
+// LinePair is a pair of highlighted lines displayed side by side.
+type LinePair struct {
+	Left, Right template.HTML
+}
+
+// emptyLine is used to pad the shorter file in CodeSideBySide.
+const emptyLine template.HTML = "<div></div>"
+
+// CodeSideBySide highlights two files and returns their lines paired up for a
+// two-column layout. If the files have different line counts, the shorter
+// side is padded with empty lines so that the columns stay aligned.
+//
+// The returned boolean represents whether or not highlighting of either file
+// was aborted due to timeout.
+//
+// In the event either input content is binary, ErrBinary is returned.
+func CodeSideBySide(ctx context.Context, left, right Params) ([]LinePair, bool, error) {
+	leftLines, leftAborted, err := CodeAsLines(ctx, left)
+	if err != nil {
+		return nil, leftAborted, err
+	}
+	rightLines, rightAborted, err := CodeAsLines(ctx, right)
+	aborted := leftAborted || rightAborted
+	if err != nil {
+		return nil, aborted, err
+	}
+
+	n := len(leftLines)
+	if len(rightLines) > n {
+		n = len(rightLines)
+	}
+	pairs := make([]LinePair, n)
+	for i := range pairs {
+		pairs[i] = LinePair{Left: emptyLine, Right: emptyLine}
+		if i < len(leftLines) {
+			pairs[i].Left = leftLines[i]
+		}
+		if i < len(rightLines) {
+			pairs[i].Right = rightLines[i]
+		}
+	}
+	return pairs, aborted, nil
+}
+
 // splitHighlightedLines takes the highlighted HTML table and returns a slice
 // of highlighted strings, where each string corresponds a single line in the
 // original, highlighted file.
 func splitHighlightedLines(input template.HTML) ([]template.HTML, error) {
-	doc, err := html.Parse(strings.NewReader(string(input)))
+	_, tr, err := parseTable(string(input))
 	if err != nil {
 		return nil, err
 	}
 
 	lines := make([]template.HTML, 0)
 
-	table := doc.FirstChild.LastChild.FirstChild // html > body > table
-	if table == nil || table.Type != html.ElementNode || table.DataAtom != atom.Table {
-		return nil, fmt.Errorf("expected html->body->table, found %+v", table)
-	}
-
 	// Iterate over each table row and extract content
 	var buf bytes.Buffer
-	tr := table.FirstChild.FirstChild // table > tbody > tr
-	for tr != nil {
-		div := tr.LastChild.FirstChild // tr > td > div
-		err = html.Render(&buf, div)
-		if err != nil {
-			return nil, err
+	for ; tr != nil && !isTruncationRow(tr); tr = tr.NextSibling {
+		// The code cell of a highlighted table holds a single <div>, but
+		// that of a plain text table may hold indentation guides followed
+		// by a <span>.
+		for c := tr.LastChild.FirstChild; c != nil; c = c.NextSibling {
+			if err := html.Render(&buf, c); err != nil {
+				return nil, err
+			}
 		}
 		lines = append(lines, template.HTML(buf.String()))
 		buf.Reset()
-		tr = tr.NextSibling
 	}
 
 	return lines, nil
 }
+
+// Plaintext returns the plain text code represented by a table produced by
+// Code. The result is identical to the highlighted file content, except that
+// line endings are normalized to "\n" and a single trailing newline is
+// removed (as done by Code). A truncation row (see SRC_HIGHLIGHT_MAX_ROWS) is
+// not included.
+func Plaintext(table template.HTML) (string, error) {
+	_, firstRow, err := parseTable(string(table))
+	if err != nil {
+		return "", err
+	}
+
+	var lines []string
+	for tr := firstRow; tr != nil && !isTruncationRow(tr); tr = tr.NextSibling {
+		var buf strings.Builder
+		appendText(&buf, tr.LastChild) // tr > td.code
+		lines = append(lines, lineText(buf.String()))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// PlaintextLines is like Plaintext, but operates on the lines returned by
+// CodeAsLines.
+func PlaintextLines(lines []template.HTML) (string, error) {
+	text := make([]string, 0, len(lines))
+	for _, line := range lines {
+		t, err := highlightedLineText(line)
+		if err != nil {
+			return "", err
+		}
+		text = append(text, t)
+	}
+	return strings.Join(text, "\n"), nil
+}
+
+// highlightedLineText returns the text of a line returned by CodeAsLines,
+// without its trailing newline.
+func highlightedLineText(line template.HTML) (string, error) {
+	nodes, err := html.ParseFragment(strings.NewReader(string(line)), &html.Node{Type: html.ElementNode, DataAtom: atom.Td, Data: atom.Td.String()})
+	if err != nil {
+		return "", err
+	}
+	var buf strings.Builder
+	for _, n := range nodes {
+		appendText(&buf, n)
+	}
+	return lineText(buf.String()), nil
+}
+
+// lineText returns the text of a line given the text content of its table
+// cell. Highlighted lines include their terminating newline and blank lines
+// are represented by a single newline, so one trailing newline is removed.
+func lineText(cellText string) string {
+	return strings.TrimSuffix(cellText, "\n")
+}
@@ -1,11 +1,19 @@
 package highlight
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
 func TestPreSpansToTable_Simple(t *testing.T) {
@@ -15,7 +23,7 @@ func TestPreSpansToTable_Simple(t *testing.T) {
 
 `
 	want := `<table><tr><td class="line" data-line="1"></td><td class="code"><div><span>package</span></div></td></tr><tr><td class="line" data-line="2"></td><td class="code"><div></div></td></tr></table>`
-	got, err := preSpansToTable(input)
+	got, _, err := preSpansToTable(input, tableOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -46,7 +54,7 @@ func TestPreSpansToTable_Complex(t *testing.T) {
 </span></div></td></tr><tr><td class="line" data-line="7"></td><td class="code"><div><span style="color:#323232;">
 </span></div></td></tr><tr><td class="line" data-line="8"></td><td class="code"><div><span style="color:#323232;">
 </span></div></td></tr><tr><td class="line" data-line="9"></td><td class="code"><div></div></td></tr></table>`
-	got, err := preSpansToTable(input)
+	got, _, err := preSpansToTable(input, tableOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -55,6 +63,106 @@ func TestPreSpansToTable_Complex(t *testing.T) {
 	}
 }
 
+func TestPreSpansToTable_Partial(t *testing.T) {
+	// Truncated/garbled syntect output: an unexpected element appears partway
+	// through, after which everything is rendered as plain text.
+	input := `<pre>
+<span style="color:#a71d5d;">package</span><span> main
+</span><b>func <i>main</i>() {
+}</b><span>
+</span></pre>`
+	want := `<table><tr><td class="line" data-line="1"></td><td class="code"><div><span style="color:#a71d5d;">package</span><span> main
+</span></div></td></tr><tr><td class="line" data-line="2"></td><td class="code"><div><span>func main() {
+</span></div></td></tr><tr><td class="line" data-line="3"></td><td class="code"><div><span>}
+</span></div></td></tr><tr><td class="line" data-line="4"></td><td class="code"><div></div></td></tr></table>`
+	got, partial, err := preSpansToTable(input, tableOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !partial {
+		t.Fatal("expected partial highlighting")
+	}
+	if got != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", got, want)
+	}
+}
+
+func TestPreSpansToTable_ThemeBackground(t *testing.T) {
+	defer themeBackgrounds.Delete("Sourcegraph")
+
+	// The theme background applies to the whole table, so that the plain
+	// rows of a partial fallback match the highlighted ones.
+	input := `<pre style="background-color:#ffffff;">
+<span style="color:#a71d5d;">a
+</span><b>b</b></pre>`
+	want := `<table style="background-color:#ffffff"><tr><td class="line" data-line="1"></td><td class="code"><div><span style="color:#a71d5d;">a
+</span></div></td></tr><tr><td class="line" data-line="2"></td><td class="code"><div><span>b</span></div></td></tr></table>`
+	got, _, err := preSpansToTable(input, Params{ThemeBackground: true}.tableOptions("a\nb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", got, want)
+	}
+
+	// Disabled, or without a valid background color, the table has no style.
+	for _, test := range []struct {
+		style string
+		opt   tableOptions
+	}{
+		{style: "background-color:#ffffff;", opt: tableOptions{}},
+		{style: "", opt: tableOptions{themeBackground: true}},
+		{style: "background-color:red;x:url(a)", opt: tableOptions{themeBackground: true}},
+	} {
+		got, _, err := preSpansToTable(`<pre style="`+test.style+`"><span>a</span></pre>`, test.opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(got, "<table><tr>") {
+			t.Errorf("style %q: got %s", test.style, got)
+		}
+	}
+}
+
+func TestGeneratePlainTable_ThemeBackground(t *testing.T) {
+	p := Params{ThemeBackground: true, QueryOptions: QueryOptions{Theme: "test theme"}}
+	defer themeBackgrounds.Delete("test theme")
+
+	// Until syntect_server has returned the theme's background color, plain
+	// text tables have no style.
+	got, err := generatePlainTable("a", p.tableOptions("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(got), "<table><tr>") {
+		t.Fatalf("got %s", got)
+	}
+
+	if _, _, err := preSpansToTable(`<pre style="background-color:#123456;"><span>a</span></pre>`, p.tableOptions("a")); err != nil {
+		t.Fatal(err)
+	}
+	got, err = generatePlainTable("a", p.tableOptions("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := template.HTML(`<table style="background-color:#123456"><tr><td class="line" data-line="1"></td><td class="code"><span>a</span></td></tr></table>`)
+	if got != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", got, want)
+	}
+
+	// Other themes and callers which did not ask for the background are
+	// unaffected.
+	for _, p := range []Params{{ThemeBackground: true, QueryOptions: QueryOptions{Theme: "other theme"}}, {QueryOptions: p.QueryOptions}} {
+		got, err := generatePlainTable("a", p.tableOptions("a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(got), "<table><tr>") {
+			t.Errorf("%+v: got %s", p, got)
+		}
+	}
+}
+
 func TestGeneratePlainTable(t *testing.T) {
 	input := `line 1
 line 2
@@ -63,7 +171,7 @@ line 2
 	want := template.HTML(`<table><tr><td class="line" data-line="1"></td><td class="code"><span>line 1</span></td></tr><tr><td class="line" data-line="2"></td><td class="code"><span>line 2</span></td></tr><tr><td class="line" data-line="3"></td><td class="code"><span>
 </span></td></tr><tr><td class="line" data-line="4"></td><td class="code"><span>
 </span></td></tr></table>`)
-	got, err := generatePlainTable(input)
+	got, err := generatePlainTable(input, tableOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -80,13 +188,491 @@ func TestGeneratePlainTableSecurity(t *testing.T) {
 	want := template.HTML(`<table><tr><td class="line" data-line="1"></td><td class="code"><span>&lt;strong&gt;line 1&lt;/strong&gt;</span></td></tr><tr><td class="line" data-line="2"></td><td class="code"><span>&lt;script&gt;alert(&#34;line 2&#34;)&lt;/script&gt;</span></td></tr><tr><td class="line" data-line="3"></td><td class="code"><span>
 </span></td></tr><tr><td class="line" data-line="4"></td><td class="code"><span>
 </span></td></tr></table>`)
-	got, err := generatePlainTable(input)
+	got, err := generatePlainTable(input, tableOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", got, want)
+	}
+}
+
+func TestTablesHaveNoStructuralWhitespace(t *testing.T) {
+	// The table builders construct their node trees directly, so the only
+	// whitespace in the rendered output must come from the code itself
+	// (inside <span> elements). This keeps the payload minimal without a
+	// separate minification pass.
+	highlighted, _, err := preSpansToTable("<pre>\n<span>a\n</span><span>\n</span><span>b</span>\n</pre>", tableOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := generatePlainTable("a\n\nb", tableOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{highlighted, string(plain)} {
+		doc, err := html.Parse(strings.NewReader(table))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var walk func(n *html.Node)
+		walk = func(n *html.Node) {
+			if n.Type == html.TextNode && n.Parent.DataAtom != atom.Span && strings.TrimSpace(n.Data) == "" {
+				t.Errorf("found structural whitespace %q under <%s> in %s", n.Data, n.Parent.Data, table)
+			}
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				walk(c)
+			}
+		}
+		walk(doc)
+	}
+}
+
+func TestGeneratePlainTable_LineEndings(t *testing.T) {
+	want := template.HTML(`<table><tr><td class="line" data-line="1"></td><td class="code"><span>line 1</span></td></tr><tr><td class="line" data-line="2"></td><td class="code"><span>line 2</span></td></tr><tr><td class="line" data-line="3"></td><td class="code"><span>
+</span></td></tr><tr><td class="line" data-line="4"></td><td class="code"><span>line 4</span></td></tr></table>`)
+	tests := map[string]string{
+		"LF":    "line 1\nline 2\n\nline 4",
+		"CRLF":  "line 1\r\nline 2\r\n\r\nline 4",
+		"mixed": "line 1\nline 2\r\n\nline 4",
+	}
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := generatePlainTable(input, tableOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Fatalf("\ngot:\n%s\nwant:\n%s\n", got, want)
+			}
+		})
+	}
+
+	// As in git, a lone CR does not end a line, even in a file without LF.
+	got, err := generatePlainTable("line 1\rline 2", tableOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = template.HTML(`<table><tr><td class="line" data-line="1"></td><td class="code"><span>line 1&#13;line 2</span></td></tr></table>`)
+	if got != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", got, want)
+	}
+}
+
+func TestNormalizeNewlines(t *testing.T) {
+	tests := map[string]string{
+		"":                 "",
+		"a\nb":             "a\nb",
+		"a\r\nb\r\n":       "a\nb\n",
+		"a\rb\r":           "a\rb\r",
+		"a\r\r\nb\n\rc":    "a\nb\n\rc",
+		"\r\n\r\n\r\r\n\n": "\n\n\n\n",
+		"a\rb\nc":          "a\rb\nc",
+	}
+	for input, want := range tests {
+		if got := normalizeNewlines(input); got != want {
+			t.Errorf("normalizeNewlines(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestPlaintext(t *testing.T) {
+	tests := map[string]struct {
+		table template.HTML
+		want  string
+	}{
+		"highlighted": {
+			table: `<table><tr><td class="line" data-line="1"></td><td class="code"><div><span style="color:#a71d5d;">package</span><span> main
+</span></div></td></tr><tr><td class="line" data-line="2"></td><td class="code"><div><span>
+</span></div></td></tr><tr><td class="line" data-line="3"></td><td class="code"><div><span>	</span><span>&#34;&lt;x&gt;&#34;</span></div></td></tr></table>`,
+			want: "package main\n\n\t\"<x>\"",
+		},
+		"trailing empty row": {
+			table: `<table><tr><td class="line" data-line="1"></td><td class="code"><div><span>a
+</span></div></td></tr><tr><td class="line" data-line="2"></td><td class="code"><div></div></td></tr></table>`,
+			want: "a\n",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := Plaintext(test.table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPlaintext_RoundTrip(t *testing.T) {
+	for _, code := range []string{
+		"",
+		"a",
+		"line 1\n\n  <b>line 3</b> & \"4\"\n\n",
+		"crlf\r\nfile\r\n\r\nend",
+	} {
+		want := normalizeNewlines(code)
+
+		plain, err := generatePlainTable(code, tableOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Plaintext(plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("plain table: got %q, want %q", got, want)
+		}
+
+		// Simulate syntect output: one span per line, including the newline.
+		var pre strings.Builder
+		pre.WriteString("<pre>\n")
+		for _, line := range strings.SplitAfter(want, "\n") {
+			pre.WriteString("<span>" + html.EscapeString(line) + "</span>")
+		}
+		pre.WriteString("</pre>")
+		highlighted, _, err := preSpansToTable(pre.String(), tableOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err = Plaintext(template.HTML(highlighted))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("highlighted table: got %q, want %q", got, want)
+		}
+		lines, err := splitHighlightedLines(template.HTML(highlighted))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err = PlaintextLines(lines)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("highlighted lines: got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestPreSpansToTable_Whitespace(t *testing.T) {
+	// Python indentation, as syntect_server emits it: leading whitespace in
+	// spans of its own, nested inside the span for the enclosing scope.
+	input := "<pre>\n" +
+		"<span style=\"color:#a;\">def</span><span> f():\n</span>" +
+		"<span style=\"color:#b;\"><span>    </span><span style=\"color:#a;\">if</span><span> x:\n</span></span>" +
+		"<span style=\"color:#b;\"><span>\t    </span><span>return</span><span>  x \n</span></span>" +
+		"<span>\n</span>" +
+		"<span>  </span></pre>"
+
+	// Whitespace-only spans are kept exactly, and never merged with their
+	// neighbours.
+	want := `<table><tr><td class="line" data-line="1"></td><td class="code"><div><span style="color:#a;">def</span><span> f():
+</span></div></td></tr><tr><td class="line" data-line="2"></td><td class="code"><div><span style="color:#b;"><span>    </span><span style="color:#a;">if</span><span> x:
+</span></span></div></td></tr><tr><td class="line" data-line="3"></td><td class="code"><div><span style="color:#b;"><span>	    </span><span>return</span><span>  x 
+</span></span></div></td></tr><tr><td class="line" data-line="4"></td><td class="code"><div><span>
+</span></div></td></tr><tr><td class="line" data-line="5"></td><td class="code"><div><span>  </span></div></td></tr></table>`
+	got, _, err := preSpansToTable(input, tableOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
 	if got != want {
 		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", got, want)
 	}
+
+	text, err := Plaintext(template.HTML(got))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wantText := "def f():\n    if x:\n\t    return  x \n\n  "; text != wantText {
+		t.Fatalf("got %q, want %q", text, wantText)
+	}
+
+	// Unhighlighting long lines must keep indentation too.
+	unhighlighted, err := unhighlightLongLines(got, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, err := Plaintext(template.HTML(unhighlighted)); err != nil || text != "def f():\n    if x:\n\t    return  x \n\n  " {
+		t.Fatalf("got %q (error %v) after unhighlighting long lines", text, err)
+	}
+}
+
+func TestTables_LineNumberWidth(t *testing.T) {
+	opt := Params{FixedLineNumberWidth: true}.tableOptions("1\n2\n3\n4\n5\n6\n7\n8\n9\n10")
+	if opt.lineNumberWidth != 2 {
+		t.Fatalf("got line number width %d, want 2", opt.lineNumberWidth)
+	}
+
+	highlighted, _, err := preSpansToTable("<pre>\n<span>a\n</span><span>b</span></pre>", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<table><tr><td class="line" data-line="1" style="min-width:2ch"></td><td class="code"><div><span>a
+</span></div></td></tr><tr><td class="line" data-line="2" style="min-width:2ch"></td><td class="code"><div><span>b</span></div></td></tr></table>`
+	if highlighted != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", highlighted, want)
+	}
+
+	plain, err := generatePlainTable("a\nb", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `<table><tr><td class="line" data-line="1" style="min-width:2ch"></td><td class="code"><span>a</span></td></tr><tr><td class="line" data-line="2" style="min-width:2ch"></td><td class="code"><span>b</span></td></tr></table>`
+	if string(plain) != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", plain, want)
+	}
+}
+
+func TestTables_LineAnchors(t *testing.T) {
+	opt := Params{LineAnchors: true}.tableOptions("a\nb")
+
+	highlighted, _, err := preSpansToTable("<pre>\n<span>a\n</span><span>b</span></pre>", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<table><tr><td class="line" data-line="1" id="L1"></td><td class="code"><div><span>a
+</span></div></td></tr><tr><td class="line" data-line="2" id="L2"></td><td class="code"><div><span>b</span></div></td></tr></table>`
+	if highlighted != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", highlighted, want)
+	}
+
+	plain, err := generatePlainTable("a\nb", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `<table><tr><td class="line" data-line="1" id="L1"></td><td class="code"><span>a</span></td></tr><tr><td class="line" data-line="2" id="L2"></td><td class="code"><span>b</span></td></tr></table>`
+	if string(plain) != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", plain, want)
+	}
+}
+
+func TestTables_LineNumberHref(t *testing.T) {
+	opt := Params{LineNumberHref: `/r/-/blob/a"b.go#L{line}`, LineAnchors: true}.tableOptions("a\nb")
+
+	highlighted, _, err := preSpansToTable("<pre>\n<span>a\n</span><span>b</span></pre>", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<table><tr><td class="line" data-line="1" id="L1"><a href="/r/-/blob/a&#34;b.go#L1">1</a></td><td class="code"><div><span>a
+</span></div></td></tr><tr><td class="line" data-line="2" id="L2"><a href="/r/-/blob/a&#34;b.go#L2">2</a></td><td class="code"><div><span>b</span></div></td></tr></table>`
+	if highlighted != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", highlighted, want)
+	}
+
+	plain, err := generatePlainTable("a\nb", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `<table><tr><td class="line" data-line="1" id="L1"><a href="/r/-/blob/a&#34;b.go#L1">1</a></td><td class="code"><span>a</span></td></tr><tr><td class="line" data-line="2" id="L2"><a href="/r/-/blob/a&#34;b.go#L2">2</a></td><td class="code"><span>b</span></td></tr></table>`
+	if string(plain) != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", plain, want)
+	}
+	if text, err := Plaintext(plain); err != nil || text != "a\nb" {
+		t.Fatalf("got %q (error %v), want %q", text, err, "a\nb")
+	}
+
+	// Unsafe URLs are ignored, leaving plain line numbers.
+	if opt := (Params{LineNumberHref: "javascript:alert({line})"}).tableOptions("a"); opt.lineNumberHref != "" {
+		t.Fatalf("got line number href %q, want none", opt.lineNumberHref)
+	}
+}
+
+func TestTables_LineNumberWindow(t *testing.T) {
+	opt := Params{LineNumberWindow: LineRange{Start: 2, End: 2}, LineAnchors: true}.tableOptions("a\nb\nc")
+
+	highlighted, _, err := preSpansToTable("<pre>\n<span>a\n</span><span>b\n</span><span>c</span></pre>", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<table><tr><td class="line" id="L1"></td><td class="code"><div><span>a
+</span></div></td></tr><tr><td class="line" data-line="2" id="L2"></td><td class="code"><div><span>b
+</span></div></td></tr><tr><td class="line" id="L3"></td><td class="code"><div><span>c</span></div></td></tr></table>`
+	if highlighted != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", highlighted, want)
+	}
+
+	plain, err := generatePlainTable("a\nb\nc", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `<table><tr><td class="line" id="L1"></td><td class="code"><span>a</span></td></tr><tr><td class="line" data-line="2" id="L2"></td><td class="code"><span>b</span></td></tr><tr><td class="line" id="L3"></td><td class="code"><span>c</span></td></tr></table>`
+	if string(plain) != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", plain, want)
+	}
+}
+
+func TestTables_RowClasses(t *testing.T) {
+	opt := Params{RowClasses: map[int]string{2: "diff-added"}}.tableOptions("a\nb")
+
+	highlighted, _, err := preSpansToTable("<pre>\n<span>a\n</span><span>b</span></pre>", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<table><tr><td class="line" data-line="1"></td><td class="code"><div><span>a
+</span></div></td></tr><tr class="diff-added"><td class="line" data-line="2"></td><td class="code"><div><span>b</span></div></td></tr></table>`
+	if highlighted != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", highlighted, want)
+	}
+
+	plain, err := generatePlainTable("a\nb", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `<table><tr><td class="line" data-line="1"></td><td class="code"><span>a</span></td></tr><tr class="diff-added"><td class="line" data-line="2"></td><td class="code"><span>b</span></td></tr></table>`
+	if string(plain) != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", plain, want)
+	}
+}
+
+func TestTables_HeaderRows(t *testing.T) {
+	rowClasses := map[int]string{1: "diff-added"}
+	opt := Params{HeaderRows: LineRange{Start: 1, End: 1}, RowClasses: rowClasses, LineAnchors: true}.tableOptions("a,b\n1,2")
+	if len(rowClasses) != 1 {
+		t.Fatal("RowClasses was modified")
+	}
+
+	plain, err := generatePlainTable("a,b\n1,2", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<table><tr class="diff-added header"><td class="line" data-line="1" id="L1"></td><td class="code"><span>a,b</span></td></tr><tr><td class="line" data-line="2" id="L2"></td><td class="code"><span>1,2</span></td></tr></table>`
+	if string(plain) != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", plain, want)
+	}
+
+	// Rows outside of the file are ignored.
+	got := withHeaderRows(nil, LineRange{Start: 0, End: 5}, 2)
+	if diff := cmp.Diff(map[int]string{1: "header", 2: "header"}, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestTruncateLines(t *testing.T) {
+	tests := []struct {
+		code      string
+		max       int
+		want      string
+		truncated int
+	}{
+		{code: "a\nb\nc", max: 0, want: "a\nb\nc"},
+		{code: "a\nb\nc", max: 3, want: "a\nb\nc"},
+		{code: "a\nb\nc", max: 2, want: "a\nb", truncated: 1},
+		{code: "a\n\n\nd", max: 1, want: "a", truncated: 3},
+		{code: "", max: 1, want: ""},
+	}
+	for _, test := range tests {
+		got, truncated := truncateLines(test.code, test.max)
+		if got != test.want || truncated != test.truncated {
+			t.Errorf("truncateLines(%q, %d) = %q, %d, want %q, %d", test.code, test.max, got, truncated, test.want, test.truncated)
+		}
+	}
+}
+
+func TestTables_Truncated(t *testing.T) {
+	opt := tableOptions{truncatedLines: 42}
+
+	highlighted, _, err := preSpansToTable("<pre>\n<span>a</span></pre>", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<table><tr><td class="line" data-line="1"></td><td class="code"><div><span>a</span></div></td></tr><tr class="truncated" data-truncated-lines="42"><td class="line"></td><td class="code"><div><span>… 42 more lines not shown</span></div></td></tr></table>`
+	if highlighted != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", highlighted, want)
+	}
+
+	plain, err := generatePlainTable("a", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `<table><tr><td class="line" data-line="1"></td><td class="code"><span>a</span></td></tr><tr class="truncated" data-truncated-lines="42"><td class="line"></td><td class="code"><span>… 42 more lines not shown</span></td></tr></table>`
+	if string(plain) != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", plain, want)
+	}
+
+	// The truncation row is not part of the code.
+	if text, err := Plaintext(template.HTML(highlighted)); err != nil || text != "a" {
+		t.Fatalf("got %q (error %v), want %q", text, err, "a")
+	}
+	lines, err := splitHighlightedLines(template.HTML(highlighted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines, want 1", len(lines))
+	}
+}
+
+func TestCode_NotTruncated(t *testing.T) {
+	orig := maxRows
+	maxRows = 2
+	defer func() { maxRows = orig }()
+
+	// Callers index the lines returned by CodeAsLines by line number, so all
+	// lines are returned.
+	lines, _, err := CodeAsLines(context.Background(), Params{Content: []byte("a\nb\nc\nd"), Filepath: "a.txt", Plaintext: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines, want 4", len(lines))
+	}
+
+	// Raw HTML has no truncation marker, so it is not truncated either.
+	raw, _, err := Code(context.Background(), Params{Content: []byte("a\nb\nc\nd"), Filepath: "a.txt", Plaintext: true, RawHTML: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := template.HTML("<pre>\na\nb\nc\nd</pre>"); raw != want {
+		t.Fatalf("got %q, want %q", raw, want)
+	}
+}
+
+func TestTables_Grid(t *testing.T) {
+	opt := Params{Grid: true}.tableOptions("a\nb")
+
+	highlighted, _, err := preSpansToTable("<pre>\n<span>a\n</span><span>b</span></pre>", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<div role="table"><div role="row"><div role="cell" class="line" data-line="1"></div><div role="cell" class="code"><div><span>a
+</span></div></div></div><div role="row"><div role="cell" class="line" data-line="2"></div><div role="cell" class="code"><div><span>b</span></div></div></div></div>`
+	if highlighted != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", highlighted, want)
+	}
+
+	plain, err := generatePlainTable("a\nb", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `<div role="table"><div role="row"><div role="cell" class="line" data-line="1"></div><div role="cell" class="code"><span>a</span></div></div><div role="row"><div role="cell" class="line" data-line="2"></div><div role="cell" class="code"><span>b</span></div></div></div>`
+	if string(plain) != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", plain, want)
+	}
+
+	// The grid layout can be post-processed like the default table.
+	unhighlighted, err := unhighlightLongLines(highlighted, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, err := Plaintext(template.HTML(unhighlighted)); err != nil || text != "a\nb" {
+		t.Fatalf("got %q (error %v), want %q", text, err, "a\nb")
+	}
+}
+
+func TestGeneratePlain_RawHTML(t *testing.T) {
+	got, err := generatePlain("\n<b>a</b>\r\nb", Params{RawHTML: true}, tableOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := template.HTML("<pre>\n\n&lt;b&gt;a&lt;/b&gt;\nb</pre>")
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
 }
 
 func TestIssue6892(t *testing.T) {
@@ -96,7 +682,7 @@ func TestIssue6892(t *testing.T) {
 </pre>`
 	want := `<table><tr><td class="line" data-line="1"></td><td class="code"><div><span>
 </span></div></td></tr><tr><td class="line" data-line="2"></td><td class="code"><div><span style="color:#9b9b9b;">import</span></div></td></tr><tr><td class="line" data-line="3"></td><td class="code"><div></div></td></tr></table>`
-	got, err := preSpansToTable(input)
+	got, _, err := preSpansToTable(input, tableOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -218,3 +804,328 @@ line3`
 		t.Fatalf("wrong highlighted lines: %s", diff)
 	}
 }
+
+func TestWriteCode(t *testing.T) {
+	Mocks.Code = func(p Params) (h template.HTML, aborted bool, err error) {
+		return `<table><tr><td class="line" data-line="1"></td><td class="code"><div><span>x</span></div></td></tr></table>`, true, nil
+	}
+	t.Cleanup(ResetMocks)
+
+	var buf strings.Builder
+	aborted, err := WriteCode(context.Background(), &buf, Params{
+		Content:  []byte("x"),
+		Filepath: `dir/"quoted".go`,
+		Metadata: Metadata{Revision: "abc123"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !aborted {
+		t.Fatal("expected aborted to be propagated")
+	}
+	want := `<div class="highlighted-code" data-filepath="dir/&#34;quoted&#34;.go" data-revision="abc123"><table><tr><td class="line" data-line="1"></td><td class="code"><div><span>x</span></div></td></tr></table></div>`
+	if got := buf.String(); got != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", got, want)
+	}
+}
+
+func TestWithDefaultExtension(t *testing.T) {
+	orig := defaultExtension
+	t.Cleanup(func() { defaultExtension = orig })
+
+	defaultExtension = ""
+	if _, ok := withDefaultExtension("bin/run", "echo hi"); ok {
+		t.Fatal("expected no default extension when unset")
+	}
+
+	defaultExtension = "sh"
+	tests := []struct {
+		filepath, code string
+		want           string
+		wantOK         bool
+	}{
+		{filepath: "bin/run", code: "echo hi", want: "bin/run.sh", wantOK: true},
+		{filepath: "bin/run", code: "#!/usr/bin/env python\nprint(1)"},
+		{filepath: "bin/run.py", code: "print(1)"},
+		{filepath: "dir.d/run", code: "echo hi", want: "dir.d/run.sh", wantOK: true},
+	}
+	for _, test := range tests {
+		got, ok := withDefaultExtension(test.filepath, test.code)
+		if got != test.want || ok != test.wantOK {
+			t.Errorf("withDefaultExtension(%q, %q) = %q, %v, want %q, %v", test.filepath, test.code, got, ok, test.want, test.wantOK)
+		}
+	}
+}
+
+func TestPreSpansToTable_Nested(t *testing.T) {
+	input := `<pre>
+<span style="color:#aaa;">a <span style="color:#bbb;">b
+c</span> d
+</span><span>e</span></pre>`
+
+	// Nested spans are preserved, and closed and reopened at row boundaries.
+	want := `<table><tr><td class="line" data-line="1"></td><td class="code"><div><span style="color:#aaa;">a <span style="color:#bbb;">b
+</span></span></div></td></tr><tr><td class="line" data-line="2"></td><td class="code"><div><span style="color:#aaa;"><span style="color:#bbb;">c</span> d
+</span></div></td></tr><tr><td class="line" data-line="3"></td><td class="code"><div><span>e</span></div></td></tr></table>`
+	got, partial, err := preSpansToTable(input, tableOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if partial {
+		t.Fatal("expected nested spans to be highlighted")
+	}
+	if got != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", got, want)
+	}
+
+	// Spans nested deeper than maxSpanDepth are flattened into their parent.
+	orig := maxSpanDepth
+	maxSpanDepth = 1
+	defer func() { maxSpanDepth = orig }()
+	want = `<table><tr><td class="line" data-line="1"></td><td class="code"><div><span style="color:#aaa;">a b
+</span></div></td></tr><tr><td class="line" data-line="2"></td><td class="code"><div><span style="color:#aaa;">c d
+</span></div></td></tr><tr><td class="line" data-line="3"></td><td class="code"><div><span>e</span></div></td></tr></table>`
+	got, _, err = preSpansToTable(input, tableOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", got, want)
+	}
+}
+
+func TestPreSpansToTable_EscapesLikeRender(t *testing.T) {
+	// A lone "\r" is escaped (as html.Render does), so that it is not read
+	// back as a line break.
+	input := "<pre>\n<span title=\"x&#13;y\">a&#13;b &lt;&amp;&#39;&#34;&gt;</span></pre>"
+	want := `<table><tr><td class="line" data-line="1"></td><td class="code"><div><span title="x&#13;y">a&#13;b &lt;&amp;&#39;&#34;&gt;</span></div></td></tr></table>`
+	got, _, err := preSpansToTable(input, tableOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", got, want)
+	}
+
+	// The cells are byte-identical to rendering them with html.Render.
+	_, tr, err := parseTable(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rendered bytes.Buffer
+	if err := html.Render(&rendered, tr.LastChild); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(got, rendered.String()) {
+		t.Fatalf("\nrendered:\n%s\nnot in:\n%s\n", rendered.String(), got)
+	}
+}
+
+// withFakeSyntect points Code at a fake syntect_server serving handler for
+// the rest of the test.
+func withFakeSyntect(t *testing.T, handler http.HandlerFunc) {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	orig := client
+	client = newServerPool(srv.URL)
+	t.Cleanup(func() { client = orig })
+}
+
+func TestCode_CRLF(t *testing.T) {
+	// A fake syntect_server which wraps each line of the code it receives
+	// in a span, keeping any "\r".
+	withFakeSyntect(t, func(w http.ResponseWriter, r *http.Request) {
+		var q struct{ Filepath, Code string }
+		if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var pre strings.Builder
+		pre.WriteString("<pre>\n")
+		for _, line := range strings.SplitAfter(q.Code, "\n") {
+			pre.WriteString("<span>" + html.EscapeString(line) + "</span>")
+		}
+		pre.WriteString("</pre>")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": pre.String()})
+	})
+
+	got, _, err := Code(context.Background(), Params{Content: []byte("a\r\n\r\nb\r\n"), Filepath: "a.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(got), "\r") {
+		t.Fatalf("unexpected \\r in highlighted output: %q", got)
+	}
+	if text, err := Plaintext(got); err != nil || text != "a\n\nb" {
+		t.Fatalf("got %q (error %v), want %q", text, err, "a\n\nb")
+	}
+}
+
+func TestCode_InvalidUTF8(t *testing.T) {
+	withFakeSyntect(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("{\"data\":\"<pre>\\n<span>a\xff</span>\\n</pre>\",\"plaintext\":false}"))
+	})
+
+	got, aborted, err := Code(context.Background(), Params{Content: []byte("a"), Filepath: "a.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aborted {
+		t.Fatal("expected highlighting not to be aborted")
+	}
+	want := template.HTML(`<table><tr><td class="line" data-line="1"></td><td class="code"><span>a</span></td></tr></table>`)
+	if got != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", got, want)
+	}
+}
+
+func TestCode_QueryOptions(t *testing.T) {
+	var theme, stabilizeTimeout string
+	withFakeSyntect(t, func(w http.ResponseWriter, r *http.Request) {
+		var q struct{ Theme string }
+		if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		theme, stabilizeTimeout = q.Theme, r.Header.Get("X-Stabilize-Timeout")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": "<pre>\n<span>a</span></pre>"})
+	})
+
+	tests := []struct {
+		name                   string
+		params                 Params
+		wantTheme, wantTimeout string
+	}{
+		{"defaults", Params{}, "Sourcegraph", ""},
+		{"light theme", Params{IsLightTheme: true, DisableTimeout: true}, "Sourcegraph (light)", "30s"},
+		{"overrides", Params{IsLightTheme: true, DisableTimeout: true, QueryOptions: QueryOptions{Theme: "Solarized (dark)", StabilizeTimeout: 5 * time.Second}}, "Solarized (dark)", "5s"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := test.params
+			p.Content, p.Filepath = []byte("a"), "a.go"
+			if _, _, err := Code(context.Background(), p); err != nil {
+				t.Fatal(err)
+			}
+			if theme != test.wantTheme || stabilizeTimeout != test.wantTimeout {
+				t.Fatalf("got theme %q and stabilize timeout %q, want %q and %q", theme, stabilizeTimeout, test.wantTheme, test.wantTimeout)
+			}
+		})
+	}
+}
+
+func TestCode_ResponseTooLarge(t *testing.T) {
+	withFakeSyntect(t, func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": `<pre>
+<span style="color:#ff0000;">a</span></pre>`})
+	})
+
+	origMaxResponseSize := maxResponseSize
+	maxResponseSize = 10
+	defer func() { maxResponseSize = origMaxResponseSize }()
+
+	got, aborted, err := Code(context.Background(), Params{Content: []byte("a"), Filepath: "a.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aborted {
+		t.Fatal("expected highlighting not to be aborted")
+	}
+	want := template.HTML(`<table><tr><td class="line" data-line="1"></td><td class="code"><span>a</span></td></tr></table>`)
+	if got != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", got, want)
+	}
+}
+
+func TestMangledResponse(t *testing.T) {
+	tests := []struct {
+		data, code string
+		want       bool
+	}{
+		{data: "<pre>a</pre>", code: "a", want: false},
+		{data: "<pre>a\xff</pre>", code: "a", want: true},
+		{data: "<pre>a\uFFFD</pre>", code: "a", want: true},
+		{data: "<pre>a\uFFFD</pre>", code: "a\uFFFD", want: false},
+	}
+	for _, test := range tests {
+		if got := mangledResponse(test.data, test.code); got != test.want {
+			t.Errorf("mangledResponse(%q, %q) = %v, want %v", test.data, test.code, got, test.want)
+		}
+	}
+}
+
+func TestExtensionLabel(t *testing.T) {
+	tests := map[string]string{
+		"a/b/Makefile":           "none",
+		"a.b/c":                  "none",
+		"a/b.GO":                 "go",
+		"a/b.tar.gz":             "gz",
+		"a/b.averyverylongthing": "other",
+	}
+	for filepath, want := range tests {
+		if got := extensionLabel(filepath); got != want {
+			t.Errorf("extensionLabel(%q) = %q, want %q", filepath, got, want)
+		}
+	}
+}
+
+func TestCodeSideBySide(t *testing.T) {
+	tables := map[string]template.HTML{
+		"left.go": `<table><tbody><tr><td class="line" data-line="1"></td><td class="code"><div><span>a
+</span></div></td></tr><tr><td class="line" data-line="2"></td><td class="code"><div><span>b</span></div></td></tr></tbody></table>`,
+		"right.go": `<table><tbody><tr><td class="line" data-line="1"></td><td class="code"><div><span>a</span></div></td></tr></tbody></table>`,
+	}
+	Mocks.Code = func(p Params) (h template.HTML, aborted bool, err error) {
+		return tables[p.Filepath], p.Filepath == "right.go", nil
+	}
+	t.Cleanup(ResetMocks)
+
+	pairs, aborted, err := CodeSideBySide(context.Background(), Params{Filepath: "left.go"}, Params{Filepath: "right.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !aborted {
+		t.Fatal("expected aborted when either side is aborted")
+	}
+	want := []LinePair{
+		{Left: "<div><span>a\n</span></div>", Right: "<div><span>a</span></div>"},
+		{Left: "<div><span>b</span></div>", Right: "<div></div>"},
+	}
+	if diff := cmp.Diff(want, pairs); diff != "" {
+		t.Fatalf("wrong pairs: %s", diff)
+	}
+}
+
+func BenchmarkPreSpansToTable(b *testing.B) {
+	var input strings.Builder
+	input.WriteString(`<pre style="background-color:#ffffff;">` + "\n")
+	for i := 0; i < 10000; i++ {
+		input.WriteString(`<span style="font-weight:bold;color:#a71d5d;">func</span><span style="color:#323232;"> </span><span style="color:#795da3;">main</span><span style="color:#323232;">() { </span><span style="color:#183691;">&quot;x&quot;</span><span style="color:#323232;"> }` + "\n" + `</span>`)
+	}
+	input.WriteString("</pre>\n")
+	h := input.String()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := preSpansToTable(h, tableOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestParseEnvInt(t *testing.T) {
+	tests := map[string]int{
+		"10":   10,
+		"-1":   -1,
+		"":     5,
+		"1MB":  5,
+		"0x10": 5,
+	}
+	for value, want := range tests {
+		if got := parseEnvInt("SRC_TEST", value, 5); got != want {
+			t.Errorf("parseEnvInt(%q) = %d, want %d", value, got, want)
+		}
+	}
+}
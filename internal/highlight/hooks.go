@@ -0,0 +1,121 @@
+package highlight
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sourcegraph/sourcegraph/internal/env"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var linkifyURLs, _ = strconv.ParseBool(env.Get("SRC_HIGHLIGHT_LINKIFY_URLS", "false", "render http(s) URLs in highlighted code as links"))
+
+func init() {
+	if linkifyURLs {
+		RegisterHook(LinkifyURLs)
+	}
+}
+
+// A Segment is a piece of the text of a token produced by a Hook.
+type Segment struct {
+	Text string
+
+	// Href, if non-empty, renders the segment as a link. Only http and https
+	// URLs are linked; segments with other URLs are rendered as plain text.
+	Href string
+}
+
+// A Hook post-processes the text of each token (syntect_server <span>
+// element) of highlighted code, e.g. to linkify issue numbers or redact
+// secrets, returning the segments to render in its place. Segment text is
+// always HTML escaped, so hooks cannot produce arbitrary HTML.
+type Hook func(text string) []Segment
+
+// registeredHooks are the hooks applied when Params.ApplyHooks is set.
+var registeredHooks []Hook
+
+// RegisterHook registers a hook to apply to highlighted code when
+// Params.ApplyHooks is set. Hooks are applied in registration order, each to
+// the unlinked segments produced by the previous hooks. It must be called
+// during initialization.
+func RegisterHook(h Hook) {
+	registeredHooks = append(registeredHooks, h)
+}
+
+// applyHooks returns the segments of text after applying hooks.
+func applyHooks(hooks []Hook, text string) []Segment {
+	segments := []Segment{{Text: text}}
+	for _, h := range hooks {
+		var next []Segment
+		for _, s := range segments {
+			if s.Href != "" {
+				next = append(next, s)
+				continue
+			}
+			next = append(next, h(s.Text)...)
+		}
+		segments = next
+	}
+	return segments
+}
+
+// safeHref reports whether href may be rendered as a link.
+func safeHref(href string) bool {
+	u, err := url.Parse(href)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https")
+}
+
+// writeSegments writes the escaped HTML of segments to buf.
+func writeSegments(buf *strings.Builder, segments []Segment) {
+	for _, s := range segments {
+		if s.Href == "" || !safeHref(s.Href) {
+			buf.WriteString(escapeHTML(s.Text))
+			continue
+		}
+		buf.WriteString("<a")
+		writeAttrs(buf, []html.Attribute{{Key: "href", Val: s.Href}})
+		buf.WriteByte('>')
+		buf.WriteString(escapeHTML(s.Text))
+		buf.WriteString("</a>")
+	}
+}
+
+// appendSegments appends nodes representing segments to parent.
+func appendSegments(parent *html.Node, segments []Segment) {
+	for _, s := range segments {
+		text := &html.Node{Type: html.TextNode, Data: s.Text}
+		if s.Href == "" || !safeHref(s.Href) {
+			parent.AppendChild(text)
+			continue
+		}
+		a := &html.Node{Type: html.ElementNode, DataAtom: atom.A, Data: atom.A.String(), Attr: []html.Attribute{{Key: "href", Val: s.Href}}}
+		a.AppendChild(text)
+		parent.AppendChild(a)
+	}
+}
+
+// urlPattern matches http(s) URLs, excluding trailing punctuation which is
+// more likely to belong to the surrounding text.
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"'` + "`" + `]*[^\s<>"'` + "`" + `.,;:!?)\]}]`)
+
+// LinkifyURLs is a Hook which links http(s) URLs.
+func LinkifyURLs(text string) []Segment {
+	var (
+		segments []Segment
+		last     int
+	)
+	for _, m := range urlPattern.FindAllStringIndex(text, -1) {
+		if m[0] > last {
+			segments = append(segments, Segment{Text: text[last:m[0]]})
+		}
+		segments = append(segments, Segment{Text: text[m[0]:m[1]], Href: text[m[0]:m[1]]})
+		last = m[1]
+	}
+	if last < len(text) || len(segments) == 0 {
+		segments = append(segments, Segment{Text: text[last:]})
+	}
+	return segments
+}
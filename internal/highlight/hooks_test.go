@@ -0,0 +1,82 @@
+package highlight
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLinkifyURLs(t *testing.T) {
+	tests := []struct {
+		text string
+		want []Segment
+	}{
+		{text: "", want: []Segment{{Text: ""}}},
+		{text: "no links\n", want: []Segment{{Text: "no links\n"}}},
+		{
+			text: "// See https://example.com/a?b=c.\n",
+			want: []Segment{
+				{Text: "// See "},
+				{Text: "https://example.com/a?b=c", Href: "https://example.com/a?b=c"},
+				{Text: ".\n"},
+			},
+		},
+		{
+			text: `"http://a.com" (http://b.com)`,
+			want: []Segment{
+				{Text: `"`},
+				{Text: "http://a.com", Href: "http://a.com"},
+				{Text: `" (`},
+				{Text: "http://b.com", Href: "http://b.com"},
+				{Text: ")"},
+			},
+		},
+	}
+	for _, test := range tests {
+		if diff := cmp.Diff(test.want, LinkifyURLs(test.text)); diff != "" {
+			t.Errorf("LinkifyURLs(%q) (-want +got):\n%s", test.text, diff)
+		}
+	}
+}
+
+func TestTables_Hooks(t *testing.T) {
+	redact := func(text string) []Segment {
+		return []Segment{{Text: strings.ReplaceAll(text, "hunter2", "*******")}}
+	}
+	unsafe := func(text string) []Segment {
+		return []Segment{{Text: text, Href: "javascript:alert(1)"}}
+	}
+	opt := tableOptions{hooks: []Hook{LinkifyURLs, redact}}
+
+	highlighted, _, err := preSpansToTable(`<pre>
+<span style="color:#aaa;">// &lt;b&gt; https://a.com/&lt;x&gt; hunter2
+</span><span>b</span></pre>`, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `<table><tr><td class="line" data-line="1"></td><td class="code"><div><span style="color:#aaa;">// &lt;b&gt; <a href="https://a.com/">https://a.com/</a>&lt;x&gt; *******
+</span></div></td></tr><tr><td class="line" data-line="2"></td><td class="code"><div><span>b</span></div></td></tr></table>`
+	if highlighted != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", highlighted, want)
+	}
+
+	plain, err := generatePlainTable("see http://a.com/?q=\"x\"", opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `<table><tr><td class="line" data-line="1"></td><td class="code"><span>see <a href="http://a.com/?q=">http://a.com/?q=</a>&#34;x&#34;</span></td></tr></table>`
+	if string(plain) != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", plain, want)
+	}
+
+	// Hooks cannot link to unsafe URLs.
+	plain, err = generatePlainTable("a", tableOptions{hooks: []Hook{unsafe}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `<table><tr><td class="line" data-line="1"></td><td class="code"><span>a</span></td></tr></table>`
+	if string(plain) != want {
+		t.Fatalf("\ngot:\n%s\nwant:\n%s\n", plain, want)
+	}
+}
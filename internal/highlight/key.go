@@ -0,0 +1,30 @@
+package highlight
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+
+	"github.com/sourcegraph/gosyntect"
+)
+
+// queryKey returns a key identifying the highlighted output of q, suitable for
+// caching or deduplicating highlight requests.
+//
+// Each field is length-prefixed before being hashed, so that moving bytes
+// between adjacent fields (e.g. from the end of the file path to the start of
+// the code) always produces a different key, unlike plain concatenation.
+func queryKey(q *gosyntect.Query) string {
+	h := sha256.New()
+	writeKeyField(h, q.Filepath)
+	writeKeyField(h, q.Theme)
+	writeKeyField(h, q.Code)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func writeKeyField(h hash.Hash, s string) {
+	var n [binary.MaxVarintLen64]byte
+	h.Write(n[:binary.PutUvarint(n[:], uint64(len(s)))])
+	h.Write([]byte(s))
+}
@@ -0,0 +1,36 @@
+package highlight
+
+import (
+	"testing"
+
+	"github.com/sourcegraph/gosyntect"
+)
+
+func TestQueryKey(t *testing.T) {
+	queries := []*gosyntect.Query{
+		{Filepath: "a.go", Theme: "Sourcegraph", Code: "package a"},
+		// Same concatenation of fields, different boundaries.
+		{Filepath: "a.goS", Theme: "ourcegraph", Code: "package a"},
+		{Filepath: "a.go", Theme: "Sourcegraphp", Code: "ackage a"},
+		{Filepath: "", Theme: "a.goSourcegraph", Code: "package a"},
+		{Filepath: "a.goSourcegraphpackage a"},
+		{Code: "a.goSourcegraphpackage a"},
+		// Different theme only.
+		{Filepath: "a.go", Theme: "Sourcegraph (light)", Code: "package a"},
+	}
+	seen := map[string]int{}
+	for i, q := range queries {
+		key := queryKey(q)
+		if j, ok := seen[key]; ok {
+			t.Errorf("queries %d and %d have the same key %s", j, i, key)
+		}
+		seen[key] = i
+	}
+
+	// Fields which do not affect the output do not affect the key.
+	a := &gosyntect.Query{Filepath: "a.go", Theme: "Sourcegraph", Code: "package a"}
+	b := &gosyntect.Query{Filepath: "a.go", Theme: "Sourcegraph", Code: "package a", StabilizeTimeout: 1}
+	if queryKey(a) != queryKey(b) {
+		t.Error("expected equal keys for queries with equal output")
+	}
+}
@@ -0,0 +1,106 @@
+package highlight
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// MarkColumns wraps the text of a highlighted line (as returned by
+// CodeAsLines) between the character columns startCol (inclusive) and endCol
+// (exclusive) in <span class="selection-highlight"> elements, e.g. to
+// emphasize a symbol referenced by a location. Columns are 0-based and count
+// Unicode code points.
+//
+// The syntax highlighting spans are left intact: when the range straddles
+// multiple spans, the covered text of each of them is wrapped separately.
+func MarkColumns(line template.HTML, startCol, endCol int) (template.HTML, error) {
+	if startCol < 0 || endCol < startCol {
+		return "", fmt.Errorf("invalid column range [%d, %d)", startCol, endCol)
+	}
+	if startCol == endCol {
+		return line, nil
+	}
+
+	context := &html.Node{Type: html.ElementNode, DataAtom: atom.Body, Data: atom.Body.String()}
+	nodes, err := html.ParseFragment(strings.NewReader(string(line)), context)
+	if err != nil {
+		return "", err
+	}
+
+	col := 0
+	var mark func(n *html.Node)
+	mark = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; {
+			next := c.NextSibling
+			if c.Type != html.TextNode {
+				mark(c)
+				c = next
+				continue
+			}
+
+			length := utf8.RuneCountInString(c.Data)
+			start, end := startCol-col, endCol-col
+			col += length
+			if end <= 0 || start >= length {
+				c = next
+				continue // no overlap
+			}
+			if start < 0 {
+				start = 0
+			}
+			if end > length {
+				end = length
+			}
+			before, covered, after := splitRunes(c.Data, start, end)
+			if before != "" {
+				n.InsertBefore(&html.Node{Type: html.TextNode, Data: before}, c)
+			}
+			span := &html.Node{
+				Type:     html.ElementNode,
+				DataAtom: atom.Span,
+				Data:     atom.Span.String(),
+				Attr:     []html.Attribute{{Key: "class", Val: "selection-highlight"}},
+			}
+			span.AppendChild(&html.Node{Type: html.TextNode, Data: covered})
+			n.InsertBefore(span, c)
+			if after != "" {
+				n.InsertBefore(&html.Node{Type: html.TextNode, Data: after}, c)
+			}
+			n.RemoveChild(c)
+			c = next
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		mark(n)
+		if err := html.Render(&buf, n); err != nil {
+			return "", err
+		}
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// splitRunes splits s into the parts before, between and after the rune
+// offsets start and end.
+func splitRunes(s string, start, end int) (before, covered, after string) {
+	startByte, endByte := len(s), len(s)
+	i := 0
+	for offset := range s {
+		if i == start {
+			startByte = offset
+		}
+		if i == end {
+			endByte = offset
+			break
+		}
+		i++
+	}
+	return s[:startByte], s[startByte:endByte], s[endByte:]
+}
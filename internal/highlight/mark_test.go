@@ -0,0 +1,60 @@
+package highlight
+
+import (
+	"html/template"
+	"testing"
+)
+
+func TestMarkColumns(t *testing.T) {
+	line := template.HTML(`<div><span style="color:#c0c5ce;">	</span><span style="color:#fff3bf;">ServeHTTP</span><span style="color:#c0c5ce;">(w, é&lt;r&gt;)
+</span></div>`)
+	tests := []struct {
+		name             string
+		startCol, endCol int
+		want             template.HTML
+	}{
+		{
+			name:     "within one span",
+			startCol: 2, endCol: 4,
+			want: `<div><span style="color:#c0c5ce;">	</span><span style="color:#fff3bf;">S<span class="selection-highlight">er</span>veHTTP</span><span style="color:#c0c5ce;">(w, é&lt;r&gt;)
+</span></div>`,
+		},
+		{
+			name:     "straddling spans",
+			startCol: 0, endCol: 12,
+			want: `<div><span style="color:#c0c5ce;"><span class="selection-highlight">	</span></span><span style="color:#fff3bf;"><span class="selection-highlight">ServeHTTP</span></span><span style="color:#c0c5ce;"><span class="selection-highlight">(w</span>, é&lt;r&gt;)
+</span></div>`,
+		},
+		{
+			name:     "multi-byte characters",
+			startCol: 14, endCol: 17,
+			want: `<div><span style="color:#c0c5ce;">	</span><span style="color:#fff3bf;">ServeHTTP</span><span style="color:#c0c5ce;">(w, <span class="selection-highlight">é&lt;r</span>&gt;)
+</span></div>`,
+		},
+		{
+			name:     "empty range",
+			startCol: 3, endCol: 3,
+			want: line,
+		},
+		{
+			name:     "past end of line",
+			startCol: 100, endCol: 200,
+			want: line,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := MarkColumns(line, test.startCol, test.endCol)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Fatalf("\ngot:\n%s\nwant:\n%s\n", got, test.want)
+			}
+		})
+	}
+
+	if _, err := MarkColumns(line, 5, 4); err == nil {
+		t.Fatal("expected error for invalid range")
+	}
+}
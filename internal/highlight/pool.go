@@ -0,0 +1,123 @@
+package highlight
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sourcegraph/gosyntect"
+)
+
+// unhealthyCooldown is how long a syntect_server instance which failed to
+// serve a request is skipped for.
+const unhealthyCooldown = 10 * time.Second
+
+var metricServerHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "src_syntax_highlighting_server_healthy",
+	Help: "Whether a syntect_server instance is considered healthy (1) or is being skipped after failing to serve a request (0).",
+}, []string{"server"})
+
+// serverPool load-balances highlight requests across syntect_server
+// instances, failing over to the next instance when one is unavailable.
+type serverPool struct {
+	servers []*syntectServerInstance
+	next    uint32
+}
+
+type syntectServerInstance struct {
+	addr   string
+	client *gosyntect.Client
+
+	mu             sync.Mutex
+	unhealthyUntil time.Time
+}
+
+// newServerPool returns a pool of the syntect_server instances in addrs, a
+// comma-separated list of addresses.
+func newServerPool(addrs string) *serverPool {
+	p := &serverPool{}
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		p.servers = append(p.servers, &syntectServerInstance{addr: addr, client: gosyntect.New(addr)})
+		metricServerHealthy.WithLabelValues(addr).Set(1)
+	}
+	return p
+}
+
+// Highlight highlights q with the next healthy syntect_server instance. If
+// the instance is unavailable, it is skipped for unhealthyCooldown and the
+// request is retried with the next one. If all instances are unhealthy, the
+// request is still attempted with one of them.
+func (p *serverPool) Highlight(ctx context.Context, q *gosyntect.Query) (*gosyntect.Response, error) {
+	if len(p.servers) == 0 {
+		return nil, errors.New("no syntect_server address configured")
+	}
+
+	start := int(atomic.AddUint32(&p.next, 1))
+	var (
+		resp  *gosyntect.Response
+		err   error
+		tried bool
+	)
+	for i := range p.servers {
+		s := p.servers[(start+i)%len(p.servers)]
+		if !s.healthy() {
+			continue
+		}
+		tried = true
+		resp, err = s.client.Highlight(ctx, q)
+		if err == nil || !unavailable(ctx, err) {
+			return resp, err
+		}
+		s.markUnhealthy(err)
+	}
+	if !tried {
+		return p.servers[start%len(p.servers)].client.Highlight(ctx, q)
+	}
+	return resp, err
+}
+
+// unavailable reports whether err indicates that a syntect_server instance
+// could not serve a request at all, as opposed to errors caused by the
+// request itself (which would occur with any instance).
+func unavailable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	switch errors.Cause(err) {
+	case gosyntect.ErrRequestTooLarge, gosyntect.ErrInvalidTheme, gosyntect.ErrPanic, gosyntect.ErrHSSWorkerTimeout:
+		return false
+	}
+	return true
+}
+
+func (s *syntectServerInstance) healthy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.unhealthyUntil.IsZero() {
+		return true
+	}
+	if time.Now().Before(s.unhealthyUntil) {
+		return false
+	}
+	s.unhealthyUntil = time.Time{}
+	metricServerHealthy.WithLabelValues(s.addr).Set(1)
+	return true
+}
+
+func (s *syntectServerInstance) markUnhealthy(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	log15.Warn("syntect_server instance unavailable, failing over to the next instance", "server", s.addr, "error", err)
+	s.unhealthyUntil = time.Now().Add(unhealthyCooldown)
+	metricServerHealthy.WithLabelValues(s.addr).Set(0)
+}
@@ -0,0 +1,68 @@
+package highlight
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sourcegraph/gosyntect"
+)
+
+func TestServerPool(t *testing.T) {
+	var requests int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write([]byte(`{"data":"<pre>\n<span>a</span>\n</pre>","plaintext":false}`))
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	p := newServerPool(down.URL + ", " + up.URL)
+	if len(p.servers) != 2 {
+		t.Fatalf("got %d servers, want 2", len(p.servers))
+	}
+
+	q := &gosyntect.Query{Code: "a", Filepath: "a.go", Theme: "Sourcegraph"}
+	for i := 0; i < 4; i++ {
+		if _, err := p.Highlight(context.Background(), q); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 4 {
+		t.Fatalf("got %d requests to the healthy server, want 4", n)
+	}
+	if p.servers[0].healthy() {
+		t.Fatal("expected the unavailable server to be marked unhealthy")
+	}
+	if !p.servers[1].healthy() {
+		t.Fatal("expected the available server to be healthy")
+	}
+}
+
+func TestServerPool_RequestErrorsDoNotFailOver(t *testing.T) {
+	var requests int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	a, b := httptest.NewServer(handler), httptest.NewServer(handler)
+	defer a.Close()
+	defer b.Close()
+
+	p := newServerPool(a.URL + "," + b.URL)
+	_, err := p.Highlight(context.Background(), &gosyntect.Query{Code: "a", Filepath: "a.go"})
+	if err != gosyntect.ErrRequestTooLarge {
+		t.Fatalf("got error %v, want %v", err, gosyntect.ErrRequestTooLarge)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("got %d requests, want 1", n)
+	}
+	for _, s := range p.servers {
+		if !s.healthy() {
+			t.Fatalf("expected %s to remain healthy", s.addr)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package highlight
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/inconshreveable/log15"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sourcegraph/sourcegraph/internal/env"
+)
+
+// defaultSecretPattern matches common kinds of secrets: AWS access key IDs,
+// GitHub and Slack tokens, and PEM private keys from their header through
+// their footer (or the end of the file, if the footer is missing).
+const defaultSecretPattern = `AKIA[0-9A-Z]{16}|gh[pousr]_[0-9A-Za-z]{36}|xox[abprs]-[0-9A-Za-z-]{10,}|(?s:-----BEGIN [A-Z ]*PRIVATE KEY-----.*?(?:-----END [A-Z ]*PRIVATE KEY-----|\z))`
+
+var (
+	redactSecrets, _ = strconv.ParseBool(env.Get("SRC_HIGHLIGHT_REDACT_SECRETS", "false", "replace secrets (matches of SRC_HIGHLIGHT_SECRET_PATTERN) in highlighted code with a placeholder"))
+	secretPattern    = env.Get("SRC_HIGHLIGHT_SECRET_PATTERN", defaultSecretPattern, "regular expression matching the secrets redacted when SRC_HIGHLIGHT_REDACT_SECRETS is enabled")
+)
+
+// redactedPlaceholder replaces each redacted secret.
+const redactedPlaceholder = "[REDACTED]"
+
+var metricRedactions = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "src_syntax_highlighting_redactions_total",
+	Help: "Number of secrets redacted from highlighted code.",
+})
+
+// secretRegexp is the compiled secretPattern, or nil if it is invalid.
+var secretRegexp = func() *regexp.Regexp {
+	re, err := regexp.Compile(secretPattern)
+	if err != nil {
+		log15.Error("invalid SRC_HIGHLIGHT_SECRET_PATTERN, secrets will not be redacted", "error", err)
+		return nil
+	}
+	return re
+}()
+
+// redactCode replaces matches of SRC_HIGHLIGHT_SECRET_PATTERN in code with a
+// placeholder, if SRC_HIGHLIGHT_REDACT_SECRETS is enabled. Code redacts the
+// code before it is highlighted or rendered as plain text, so secrets are
+// redacted from every kind of output (including RawHTML and the lines of
+// CodeAsLines) regardless of Params.ApplyHooks.
+func redactCode(code string) string {
+	if !redactSecrets {
+		return code
+	}
+	return redact(secretRegexp, code)
+}
+
+// redact replaces the matches of re in text with a placeholder. Any newlines
+// in a match are kept, so that line numbers do not change.
+func redact(re *regexp.Regexp, text string) string {
+	if re == nil {
+		return text
+	}
+	n := 0
+	redacted := re.ReplaceAllStringFunc(text, func(secret string) string {
+		if secret == "" {
+			return secret
+		}
+		n++
+		return redactedPlaceholder + strings.Repeat("\n", strings.Count(secret, "\n"))
+	})
+	if n > 0 {
+		metricRedactions.Add(float64(n))
+	}
+	return redacted
+}
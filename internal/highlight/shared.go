@@ -0,0 +1,65 @@
+package highlight
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/sourcegraph/gosyntect"
+	"github.com/sourcegraph/sourcegraph/internal/trace"
+	"golang.org/x/sync/singleflight"
+)
+
+// highlightGroup coalesces concurrent identical highlight requests.
+var highlightGroup singleflight.Group
+
+// highlightShared highlights query with syntect_server. Concurrent identical
+// queries (e.g. for a popular file during a traffic spike) share a single
+// request to syntect_server.
+//
+// The shared request is not bound to the ctx of the caller which started it:
+// if a caller gives up, highlightShared returns ctx.Err() but the request
+// continues for the other callers waiting on it, up to sharedRequestTimeout.
+// So a caller which joins the request late is not cut off by an earlier
+// caller's deadline. The request is traced in its own span, a child of the
+// span of the caller which started it.
+func highlightShared(ctx context.Context, query *gosyntect.Query) (*gosyntect.Response, error) {
+	// Requests with a different worker timeout may fail differently, so do
+	// not share them.
+	key := queryKey(query) + ":" + strconv.FormatInt(int64(query.StabilizeTimeout), 10)
+
+	ch := highlightGroup.DoChan(key, func() (interface{}, error) {
+		tr, sharedCtx := trace.New(trace.CopyContext(context.Background(), ctx), "highlight.shared", "")
+		sharedCtx, cancel := context.WithTimeout(sharedCtx, sharedRequestTimeout(query))
+		defer cancel()
+		resp, err := client.Highlight(sharedCtx, query)
+		tr.SetError(err)
+		tr.Finish()
+		return resp, err
+	})
+
+	select {
+	case res := <-ch:
+		if tr := trace.TraceFromContext(ctx); tr != nil {
+			tr.LogFields(otlog.Bool("shared_request", res.Shared))
+		}
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*gosyntect.Response), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// sharedRequestTimeout returns how long a shared request for query may run:
+// as long as Code waits for syntect_server by default, or slightly longer
+// than a longer syntect_server worker timeout (e.g. with
+// Params.DisableTimeout), after which syntect_server gives up itself.
+func sharedRequestTimeout(query *gosyntect.Query) time.Duration {
+	if timeout := query.StabilizeTimeout + time.Second; timeout > highlightTimeout {
+		return timeout
+	}
+	return highlightTimeout
+}
@@ -0,0 +1,109 @@
+package highlight
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/gosyntect"
+)
+
+func TestHighlightShared(t *testing.T) {
+	var (
+		requests int32
+		release  = make(chan struct{})
+	)
+	withFakeSyntect(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		_, _ = w.Write([]byte(`{"data":"<pre>\n<span>a</span>\n</pre>","plaintext":false}`))
+	})
+
+	query := func() *gosyntect.Query {
+		return &gosyntect.Query{Code: "a", Filepath: "a.go", Theme: "Sourcegraph"}
+	}
+
+	// One caller gives up while waiting, which must not affect the others.
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error, 1)
+	go func() {
+		_, err := highlightShared(canceledCtx, query())
+		canceled <- err
+	}()
+
+	var wg sync.WaitGroup
+	results := make([]*gosyntect.Response, 5)
+	errs := make([]error, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = highlightShared(context.Background(), query())
+		}(i)
+	}
+
+	// Give the callers time to join the in-flight request.
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-canceled; err != context.Canceled {
+		t.Fatalf("got error %v for the canceled caller, want %v", err, context.Canceled)
+	}
+	close(release)
+	wg.Wait()
+
+	for i := range results {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if results[i].Data != "<pre>\n<span>a</span>\n</pre>" {
+			t.Fatalf("got data %q", results[i].Data)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("got %d requests to syntect_server, want 1", n)
+	}
+}
+
+func TestHighlightShared_LateJoiner(t *testing.T) {
+	var requests int32
+	withFakeSyntect(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write([]byte(`{"data":"<pre>\n<span>b</span>\n</pre>","plaintext":false}`))
+	})
+
+	query := func() *gosyntect.Query {
+		return &gosyntect.Query{Code: "b", Filepath: "b.go", Theme: "Sourcegraph"}
+	}
+
+	// The first caller's deadline passes before syntect_server responds.
+	firstCtx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	first := make(chan error, 1)
+	go func() {
+		_, err := highlightShared(firstCtx, query())
+		first <- err
+	}()
+
+	// A caller with a longer deadline which joins shortly before the first
+	// caller's deadline still gets the result.
+	time.Sleep(30 * time.Millisecond)
+	lateCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := highlightShared(lateCtx, query())
+	if err != nil {
+		t.Fatalf("got error %v for the late caller", err)
+	}
+	if resp.Data != "<pre>\n<span>b</span>\n</pre>" {
+		t.Fatalf("got data %q", resp.Data)
+	}
+	if err := <-first; err != context.DeadlineExceeded {
+		t.Fatalf("got error %v for the first caller, want %v", err, context.DeadlineExceeded)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("got %d requests to syntect_server, want 1", n)
+	}
+}
@@ -0,0 +1,44 @@
+package highlight
+
+import (
+	"context"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// maxTableBuilds is the maximum number of highlighted tables built from
+// syntect_server responses concurrently. Parsing and rendering large
+// responses is CPU-bound, so under a burst of requests for large files an
+// unbounded number of concurrent builds could saturate the CPU.
+var maxTableBuilds = envInt("SRC_HIGHLIGHT_MAX_TABLE_BUILDS", 0, "maximum number of highlighted tables built concurrently (0 uses the number of CPUs)")
+
+// tableBuilds is a semaphore limiting the number of concurrent table builds.
+var tableBuilds = make(chan struct{}, tableBuildConcurrency())
+
+var metricTableBuildQueue = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "src_syntax_highlighting_table_build_queue",
+	Help: "Number of syntax highlighting requests waiting to build a highlighted table.",
+})
+
+func tableBuildConcurrency() int {
+	if maxTableBuilds > 0 {
+		return maxTableBuilds
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// acquireTableBuild blocks until a table build may start or ctx is done. If
+// it returns true, release must be called once the build has finished.
+func acquireTableBuild(ctx context.Context) (release func(), ok bool) {
+	metricTableBuildQueue.Inc()
+	defer metricTableBuildQueue.Dec()
+
+	select {
+	case tableBuilds <- struct{}{}:
+		return func() { <-tableBuilds }, true
+	case <-ctx.Done():
+		return nil, false
+	}
+}
@@ -0,0 +1,32 @@
+package highlight
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAcquireTableBuild(t *testing.T) {
+	orig := tableBuilds
+	tableBuilds = make(chan struct{}, 1)
+	defer func() { tableBuilds = orig }()
+
+	release, ok := acquireTableBuild(context.Background())
+	if !ok {
+		t.Fatal("expected to acquire the first table build")
+	}
+
+	// While the only slot is taken, acquiring gives up once ctx is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, ok := acquireTableBuild(ctx); ok {
+		t.Fatal("expected acquiring a second table build to fail")
+	}
+
+	release()
+	release, ok = acquireTableBuild(context.Background())
+	if !ok {
+		t.Fatal("expected to acquire a table build after release")
+	}
+	release()
+}
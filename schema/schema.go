@@ -679,6 +679,12 @@ type HTTPHeaderAuthProvider struct {
 	// UsernameHeader description: The name (case-insensitive) of an HTTP header whose value is taken to be the username of the client requesting the page. Set this value when using an HTTP proxy that authenticates requests, and you don't want the extra configurability of the other authentication methods.
 	UsernameHeader string `json:"usernameHeader"`
 }
+type HighlightPlaintextPaths struct {
+	// Paths description: File glob patterns. Patterns containing a slash are matched against the full file path, all other patterns against the file name. The glob pattern syntax can be found here: https://golang.org/pkg/path/#Match.
+	Paths []string `json:"paths"`
+	// Repository description: A regular expression matching the names of the repositories the paths apply to. The regular expression should use the Go regular expression syntax (https://golang.org/pkg/regexp/). It matches partially by default, so use "^...$" if whole-string matching is desired.
+	Repository string `json:"repository"`
+}
 
 // IdentityProvider description: The source of identity to use when computing permissions. This defines how to compute the GitLab identity to use for a given Sourcegraph user.
 type IdentityProvider struct {
@@ -1191,6 +1197,8 @@ type SiteConfiguration struct {
 	GithubClientID string `json:"githubClientID,omitempty"`
 	// GithubClientSecret description: Client secret for GitHub. (DEPRECATED)
 	GithubClientSecret string `json:"githubClientSecret,omitempty"`
+	// HighlightPlaintextPaths description: Files which are always rendered as plain text instead of being syntax highlighted (e.g. sensitive configuration templates or large data files). Each entry applies a list of file glob patterns to the repositories matching a regular expression.
+	HighlightPlaintextPaths []*HighlightPlaintextPaths `json:"highlight.plaintextPaths,omitempty"`
 	// HtmlBodyBottom description: HTML to inject at the bottom of the `<body>` element on each page, for analytics scripts
 	HtmlBodyBottom string `json:"htmlBodyBottom,omitempty"`
 	// HtmlBodyTop description: HTML to inject at the top of the `<body>` element on each page, for analytics scripts
@@ -43,6 +43,31 @@ const SiteSchemaJSON = `{
       "group": "Search",
       "examples": [["go.sum", "package-lock.json", "*.thrift"]]
     },
+    "highlight.plaintextPaths": {
+      "description": "Files which are always rendered as plain text instead of being syntax highlighted (e.g. sensitive configuration templates or large data files). Each entry applies a list of file glob patterns to the repositories matching a regular expression.",
+      "type": "array",
+      "items": {
+        "title": "HighlightPlaintextPaths",
+        "type": "object",
+        "additionalProperties": false,
+        "required": ["repository", "paths"],
+        "properties": {
+          "repository": {
+            "description": "A regular expression matching the names of the repositories the paths apply to. The regular expression should use the Go regular expression syntax (https://golang.org/pkg/regexp/). It matches partially by default, so use \"^...$\" if whole-string matching is desired.",
+            "type": "string"
+          },
+          "paths": {
+            "description": "File glob patterns. Patterns containing a slash are matched against the full file path, all other patterns against the file name. The glob pattern syntax can be found here: https://golang.org/pkg/path/#Match.",
+            "type": "array",
+            "items": {
+              "type": "string"
+            }
+          }
+        }
+      },
+      "group": "Misc.",
+      "examples": [[{ "repository": "^github\\.com/acme/app$", "paths": ["config/*.tmpl", "*.csv"] }]]
+    },
     "debug.search.symbolsParallelism": {
       "description": "(debug) controls the amount of symbol search parallelism. Defaults to 20. It is not recommended to change this outside of debugging scenarios. This option will be removed in a future version.",
       "type": "integer",
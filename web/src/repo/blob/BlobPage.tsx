@@ -66,7 +66,11 @@ const fetchBlob = memoizeObservable(
                             file(path: $filePath) {
                                 content
                                 richHTML
-                                highlight(disableTimeout: $disableTimeout, isLightTheme: $isLightTheme) {
+                                highlight(
+                                    disableTimeout: $disableTimeout
+                                    isLightTheme: $isLightTheme
+                                    lineAnchors: true
+                                ) {
                                     aborted
                                     html
                                 }